@@ -0,0 +1,224 @@
+package cryptod
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Armored streams are the binary stream in base64, wrapped in PEM-like lines:
+//
+//	-----BEGIN CRYPTOD ENCRYPTED STREAM-----
+//	Comment: nightly backup
+//
+//	U3NjYWVzMjU2Z2NtAgBzEC...
+//	-----END CRYPTOD ENCRYPTED STREAM-----
+//
+// The Comment header and the blank line after it are only written when there
+// is a comment. A binary stream starts with its header size, and no format
+// has a 45 byte header, the code of '-', so the first byte tells them apart.
+const (
+	armorBegin = "-----BEGIN CRYPTOD ENCRYPTED STREAM-----"
+	armorEnd   = "-----END CRYPTOD ENCRYPTED STREAM-----"
+
+	armorLineBytes  = 48 // bytes encoded per line
+	armorLineLength = 64 // base64 characters per line
+	armorBatchLines = 64 // lines written to the underlying writer at once
+)
+
+// WithArmor makes Encrypt write the stream as ASCII armor, base64 wrapped at
+// 64 characters between BEGIN and END lines, for channels that only carry
+// text such as tickets, YAML and email. A non-empty `comment` is written in a
+// "Comment:" header line; it is neither encrypted nor authenticated, and must
+// be a single line. The stream grows by about a third.
+//
+// Decrypt, Verify, Recover and Inspect detect armored input themselves, so no
+// option is needed to read it back. Text after the END line is ignored, and
+// offsets in errors are those of the binary stream inside the armor. Armor
+// cannot be combined with checkpoints.
+func WithArmor(comment string) Option {
+	return func(o *options) {
+		o.armor = true
+		o.armorComment = comment
+	}
+}
+
+// errArmorCheckpoint is returned when armor and checkpoints are combined:
+// checkpoint offsets are those of the binary stream, not of the armored text
+var errArmorCheckpoint = errors.New("checkpoints are not supported for armored streams")
+
+// armorWriter encodes the stream written to it as armor. It holds at most one
+// batch of lines, whatever the size of the stream.
+type armorWriter struct {
+	w   io.Writer
+	in  [armorLineBytes]byte // bytes of the current line
+	nin int
+	out []byte // lines not yet written to w
+	err error
+}
+
+// newArmorWriter returns an armorWriter to `w` with header comment `comment`.
+// Close writes the last line and the END line.
+func newArmorWriter(w io.Writer, comment string) (*armorWriter, error) {
+	if strings.ContainsAny(comment, "\r\n") {
+		return nil, errors.New("armor comment must be a single line")
+	}
+	head := armorBegin + "\n"
+	if comment != "" {
+		head += "Comment: " + comment + "\n\n"
+	}
+	out := make([]byte, 0, len(head)+armorBatchLines*(armorLineLength+1))
+	return &armorWriter{w: w, out: append(out, head...)}, nil
+}
+
+func (a *armorWriter) Write(p []byte) (int, error) {
+	n := 0
+	for a.err == nil && n < len(p) {
+		k := copy(a.in[a.nin:], p[n:])
+		a.nin += k
+		n += k
+		if a.nin == len(a.in) {
+			a.line()
+		}
+	}
+	if a.err != nil {
+		return n, a.err
+	}
+	return n, nil
+}
+
+// line encodes the current line, flushing the batch first if it is full
+func (a *armorWriter) line() {
+	if len(a.out)+armorLineLength+1 > cap(a.out) {
+		a.flush()
+	}
+	a.out = base64.StdEncoding.AppendEncode(a.out, a.in[:a.nin])
+	a.out = append(a.out, '\n')
+	a.nin = 0
+}
+
+// flush writes the encoded lines to the underlying writer
+func (a *armorWriter) flush() {
+	if a.err == nil && len(a.out) > 0 {
+		_, a.err = a.w.Write(a.out)
+	}
+	a.out = a.out[:0]
+}
+
+// Close writes the last, possibly short, line and the END line. It does not
+// close the underlying writer.
+func (a *armorWriter) Close() error {
+	if a.nin > 0 {
+		a.line()
+	}
+	if len(a.out)+len(armorEnd)+1 > cap(a.out) {
+		a.flush()
+	}
+	a.out = append(a.out, armorEnd+"\n"...)
+	a.flush()
+	return a.err
+}
+
+// dearmor returns `r` if it holds a binary stream, or a reader decoding it if
+// it is armored. It reads the first byte of `r` to tell.
+func dearmor(r io.Reader) (io.Reader, bool, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err == io.EOF {
+		return r, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	r = io.MultiReader(bytes.NewReader(b), r)
+	if b[0] != armorBegin[0] {
+		return r, false, nil
+	}
+	return newArmorReader(r), true, nil
+}
+
+// armorReader decodes an armored stream, one line at a time. Lines may be
+// wrapped at any length up to the buffer size, end in CRLF and be indented.
+type armorReader struct {
+	r       *bufio.Reader
+	line    int    // number of the last line read, for errors
+	body    bool   // past the BEGIN line and the headers
+	text    []byte // base64 characters not yet decoded, fewer than 4 between lines
+	dec     []byte // decoded bytes of the current line
+	pending []byte // part of dec not yet read
+	padded  bool   // the base64 has ended; only the END line may follow
+	err     error  // sticky, io.EOF after the END line
+}
+
+func newArmorReader(r io.Reader) *armorReader {
+	const size = 4096 // longest line
+	return &armorReader{
+		r:    bufio.NewReaderSize(r, size),
+		text: make([]byte, 0, size+4),
+		dec:  make([]byte, base64.StdEncoding.DecodedLen(size+4)),
+	}
+}
+
+func (a *armorReader) Read(p []byte) (int, error) {
+	for len(a.pending) == 0 {
+		if a.err != nil {
+			return 0, a.err
+		}
+		a.err = a.next()
+	}
+	n := copy(p, a.pending)
+	a.pending = a.pending[n:]
+	return n, nil
+}
+
+// next reads and decodes the next line, returning io.EOF after the END line
+func (a *armorReader) next() error {
+	raw, err := a.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return fmt.Errorf("%w: line %d is too long", ErrBadArmor, a.line+1)
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(raw) == 0 && err == io.EOF {
+		return fmt.Errorf("%w: armor ends before its END line", ErrTruncated)
+	}
+	a.line++
+	line := bytes.TrimSpace(raw)
+
+	switch {
+	case a.line == 1:
+		if string(line) != armorBegin {
+			return fmt.Errorf("%w: expected %q on line 1", ErrBadArmor, armorBegin)
+		}
+		return nil
+	case string(line) == armorEnd:
+		if len(a.text) > 0 {
+			return fmt.Errorf("%w: base64 ends mid-group on line %d", ErrBadArmor, a.line-1)
+		}
+		return io.EOF
+	case len(line) == 0:
+		a.body = true
+		return nil
+	case !a.body && bytes.IndexByte(line, ':') > 0:
+		return nil // a header, such as Comment
+	}
+	a.body = true
+	if a.padded {
+		return fmt.Errorf("%w: data after the end of the base64 on line %d", ErrBadArmor, a.line)
+	}
+
+	// decode whole groups of 4 characters, carrying the rest to the next line
+	a.text = append(a.text, line...)
+	n := len(a.text) / 4 * 4
+	d, derr := base64.StdEncoding.Decode(a.dec, a.text[:n])
+	if derr != nil {
+		return fmt.Errorf("%w: invalid base64 on line %d", ErrBadArmor, a.line)
+	}
+	a.padded = n > 0 && a.text[n-1] == '='
+	a.pending = a.dec[:d]
+	a.text = a.text[:copy(a.text, a.text[n:])]
+	return nil
+}
@@ -0,0 +1,185 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestArmor(t *testing.T) {
+	const key = "this is a secret"
+	for _, size := range []int{0, 1, 47, 48, 49, 5000, chunkSize*2 + 100} {
+		plaintext := generatePlainText(size)
+		for _, workers := range []int{1, 4} {
+			buf := &bytes.Buffer{}
+			if err := Encrypt(bytes.NewReader(plaintext), buf, key, WithArmor("backup"), WithConcurrency(workers)); err != nil {
+				t.Fatalf("size=%d workers=%d: encrypt error: %v", size, workers, err)
+			}
+			armored := buf.String()
+			lines := strings.Split(strings.TrimSuffix(armored, "\n"), "\n")
+			if lines[0] != armorBegin || lines[1] != "Comment: backup" || lines[2] != "" || lines[len(lines)-1] != armorEnd {
+				t.Fatalf("size=%d: unexpected armor framing:\n%s", size, armored[:min(len(armored), 200)])
+			}
+			for i, line := range lines[3 : len(lines)-1] {
+				if len(line) > armorLineLength || (len(line) < armorLineLength && i != len(lines)-5) {
+					t.Fatalf("size=%d: line %d has %d characters", size, i+4, len(line))
+				}
+			}
+
+			out := &bytes.Buffer{}
+			if err := Decrypt(strings.NewReader(armored), out, key, WithConcurrency(workers)); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+				t.Errorf("size=%d workers=%d: decrypt error: %v", size, workers, err)
+			}
+		}
+	}
+
+	// the binary stream inside is the one Encrypt writes without armor
+	plaintext := generatePlainText(chunkSize + 100)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key, WithArmor(""), WithDeterministic()); err != nil {
+		t.Fatal(err)
+	}
+	armored := buf.Bytes()
+	if !bytes.HasPrefix(armored, []byte(armorBegin+"\n")) || bytes.Contains(armored, []byte("Comment")) {
+		t.Errorf("unexpected armor without comment: %.100s", armored)
+	}
+	buf = &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key, WithDeterministic()); err != nil {
+		t.Fatal(err)
+	}
+	binary := buf.Bytes()
+	decoded, err := io.ReadAll(newArmorReader(bytes.NewReader(armored)))
+	if err != nil || !bytes.Equal(decoded, binary) {
+		t.Errorf("armor does not hold the binary stream: %v", err)
+	}
+
+	if report, err := Verify(bytes.NewReader(armored), key); err != nil || report.Chunks != 2 {
+		t.Errorf("verify: %v, %+v", err, report)
+	}
+	info, err := Inspect(bytes.NewReader(armored))
+	if err != nil || !info.Armored || info.Size != int64(len(binary)) {
+		t.Errorf("inspect: %v, %+v", err, info)
+	}
+	if info, err := Inspect(bytes.NewReader(binary)); err != nil || info.Armored {
+		t.Errorf("inspect binary: %v, %+v", err, info)
+	}
+}
+
+func TestArmorLenient(t *testing.T) {
+	const key = "this is a secret"
+	plaintext := generatePlainText(5000)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key, WithArmor("ticket 42")); err != nil {
+		t.Fatal(err)
+	}
+	armored := buf.String()
+	lines := strings.Split(strings.TrimSuffix(armored, "\n"), "\n")
+	body := strings.Join(lines[3:len(lines)-1], "")
+
+	// rewrapped at another width, with CRLF line ends, indentation and
+	// text after the END line, as pasted from an email
+	var rewrapped strings.Builder
+	rewrapped.WriteString(armorBegin + "\r\n")
+	for i := 0; i < len(body); i += 75 {
+		rewrapped.WriteString("  " + body[i:min(i+75, len(body))] + " \r\n")
+	}
+	rewrapped.WriteString(armorEnd + "\r\n-- \r\nsent from my phone\r\n")
+
+	for name, text := range map[string]string{
+		"rewrapped":  rewrapped.String(),
+		"no newline": strings.TrimSuffix(armored, "\n"), // after the END line
+	} {
+		out := &bytes.Buffer{}
+		if err := Decrypt(strings.NewReader(text), out, key); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+			t.Errorf("%s: decrypt error: %v", name, err)
+		}
+	}
+}
+
+func TestArmorRecover(t *testing.T) {
+	const key = "this is a secret"
+	plaintext := generatePlainText(chunkSize*3 + 100)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key, WithArmor("")); err != nil {
+		t.Fatal(err)
+	}
+	armored := buf.String()
+	binary, err := io.ReadAll(newArmorReader(strings.NewReader(armored)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lines holding the middle of chunk 2, and chunk 4
+	line := func(off int) int { return len(armorBegin) + 1 + off/armorLineBytes*(armorLineLength+1) }
+	mid, last := line(chunkSize*3/2), line(len(binary)-100)
+
+	out := &bytes.Buffer{}
+	report, err := Recover(strings.NewReader(armored), out, key)
+	if err != nil || !report.Intact() || !bytes.Equal(out.Bytes(), plaintext) {
+		t.Fatalf("intact armor: %v, %+v", err, report)
+	}
+
+	// a changed character loses its chunk only
+	b := []byte(armored)
+	b[mid] = map[bool]byte{true: 'B', false: 'A'}[b[mid] == 'A']
+	out.Reset()
+	report, err = Recover(bytes.NewReader(b), out, key)
+	if err != nil || report.Chunks != 3 || len(report.Lost) != 1 || !report.EndMarker {
+		t.Errorf("changed character: %v, %+v", err, report)
+	}
+
+	// armor cut short, or malformed, keeps the chunks before the damage
+	for name, text := range map[string]string{
+		"cut":     armored[:last],
+		"invalid": armored[:last] + "*\n" + armored[last:],
+	} {
+		out.Reset()
+		report, err = Recover(strings.NewReader(text), out, key)
+		if err != nil || report.Chunks != 3 || report.EndMarker || !bytes.Equal(out.Bytes(), plaintext[:chunkSize*3]) {
+			t.Errorf("%s: %v, %+v", name, err, report)
+		}
+	}
+}
+
+func TestArmorBad(t *testing.T) {
+	const key = "this is a secret"
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(generatePlainText(5000)), buf, key, WithArmor("")); err != nil {
+		t.Fatal(err)
+	}
+	armored := buf.String()
+	endAt := strings.Index(armored, armorEnd)
+	lines := strings.Split(armored, "\n")
+	lines[20], lines[21] = lines[21], lines[20]
+	swapped := strings.Join(lines, "\n")
+
+	for name, tc := range map[string]struct {
+		text string
+		want error
+	}{
+		"other label":    {strings.Replace(armored, "CRYPTOD ENCRYPTED STREAM", "PGP MESSAGE", 1), ErrBadArmor},
+		"invalid base64": {strings.Replace(armored, "\n", "\n*", 2), ErrBadArmor},
+		"no END line":    {armored[:endAt], ErrTruncated},
+		"cut mid-group":  {armored[:endAt-3] + "\n" + armorEnd + "\n", ErrBadArmor},
+		"after padding":  {armorBegin + "\nQQ==\nQUFB\n" + armorEnd + "\n", ErrBadArmor},
+		"long line":      {armorBegin + "\n" + strings.Repeat("A", 5000) + "\n", ErrBadArmor},
+		"lines swapped":  {swapped, ErrAuthentication},
+	} {
+		err := Decrypt(strings.NewReader(tc.text), io.Discard, key)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: expected %v, got %v", name, tc.want, err)
+		}
+	}
+
+	if err := Encrypt(strings.NewReader("x"), io.Discard, key, WithArmor("two\nlines")); err == nil {
+		t.Error("expected an error for a multi-line comment")
+	}
+	cp := WithCheckpoint(func(*Checkpoint) error { return nil })
+	if err := Encrypt(strings.NewReader("x"), io.Discard, key, WithArmor(""), cp); err == nil {
+		t.Error("expected an error for armor with checkpoints")
+	}
+	if err := Decrypt(strings.NewReader(armored), io.Discard, key, cp); err == nil {
+		t.Error("expected an error for armored input with checkpoints")
+	}
+}
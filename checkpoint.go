@@ -0,0 +1,475 @@
+package cryptod
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Checkpoint records how far an Encrypt or Decrypt has got, so that an
+// interrupted run can be resumed with ResumeEncrypt or ResumeDecrypt instead
+// of starting again. It describes the state just before chunk number Chunk
+// is written. Checkpoints are authenticated with a key derived from the key
+// the stream is encrypted with, bound to the associated data, and hold no
+// secrets, so they can be stored next to the output; resuming with another
+// key or associated data fails with ErrBadCheckpoint.
+type Checkpoint struct {
+	InputOffset  int64  // bytes of input consumed
+	OutputOffset int64  // bytes of output written
+	Chunk        uint64 // 1-based index of the next chunk
+
+	decrypt bool
+	header  []byte // stream header, carrying any per-stream state
+	digest  []byte // keyed digest of the plaintext of the next chunk (encrypt)
+	mac     []byte
+}
+
+const checkpointVersion = 1
+
+// WithCheckpoint installs a hook called with a checkpoint before each chunk
+// is written: when encrypting, once the chunk has been read; when
+// decrypting, once the previous chunk has been written. The hook runs on the
+// goroutine writing the output, in chunk order. It should persist the
+// checkpoint somewhere durable, after making sure the output written so far
+// is durable too (e.g. with File.Sync); it may skip checkpoints to save
+// time, in which case ResumeEncrypt checks the output written since against
+// the input. An error from the hook stops the run.
+func WithCheckpoint(fn func(*Checkpoint) error) Option {
+	return func(o *options) {
+		o.checkpoint = fn
+	}
+}
+
+// ResumableWriter is an output that can be cut back to a checkpoint, such as
+// an *os.File. ResumeEncrypt also needs io.ReaderAt to resume output that
+// goes past its checkpoint.
+type ResumableWriter interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// MarshalBinary encodes the checkpoint for storage.
+func (cp *Checkpoint) MarshalBinary() ([]byte, error) {
+	b := cp.fields()
+	b = append(b, byte(len(cp.mac)))
+	return append(b, cp.mac...), nil
+}
+
+// UnmarshalBinary decodes a checkpoint encoded with MarshalBinary. The
+// checkpoint is authenticated when it is resumed.
+func (cp *Checkpoint) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	bad := fmt.Errorf("%w: malformed checkpoint", ErrBadCheckpoint)
+
+	v, err := r.ReadByte()
+	if err != nil || v != checkpointVersion {
+		return bad
+	}
+	kind, err := r.ReadByte()
+	if err != nil || kind > 1 {
+		return bad
+	}
+	in, err1 := binary.ReadUvarint(r)
+	out, err2 := binary.ReadUvarint(r)
+	ctr, err3 := binary.ReadUvarint(r)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return bad
+	}
+	var fields [3][]byte
+	for i := range fields {
+		n, err := r.ReadByte()
+		if err != nil {
+			return bad
+		}
+		fields[i] = make([]byte, n)
+		if _, err := io.ReadFull(r, fields[i]); err != nil {
+			return bad
+		}
+	}
+	if r.Len() != 0 {
+		return bad
+	}
+	*cp = Checkpoint{
+		InputOffset:  int64(in),
+		OutputOffset: int64(out),
+		Chunk:        ctr,
+		decrypt:      kind == 1,
+		header:       fields[0],
+		digest:       fields[1],
+		mac:          fields[2],
+	}
+	return nil
+}
+
+// fields returns the authenticated part of the encoded checkpoint
+func (cp *Checkpoint) fields() []byte {
+	b := []byte{checkpointVersion, 0}
+	if cp.decrypt {
+		b[1] = 1
+	}
+	b = binary.AppendUvarint(b, uint64(cp.InputOffset))
+	b = binary.AppendUvarint(b, uint64(cp.OutputOffset))
+	b = binary.AppendUvarint(b, cp.Chunk)
+	b = append(b, byte(len(cp.header)))
+	b = append(b, cp.header...)
+	b = append(b, byte(len(cp.digest)))
+	return append(b, cp.digest...)
+}
+
+// checkpointer makes checkpoints for one stream
+type checkpointer struct {
+	fn      func(*Checkpoint) error
+	key     []byte
+	decrypt bool
+	header  []byte
+}
+
+// newCheckpointer returns a checkpointer for the stream with header `h`, or
+// nil if no checkpoint hook is installed
+func newCheckpointer(o *options, key *Key, decrypt bool, h *header) *checkpointer {
+	if o.checkpoint == nil {
+		return nil
+	}
+	return &checkpointer{fn: o.checkpoint, key: checkpointKey(key, o.ad), decrypt: decrypt, header: h.marshal()}
+}
+
+// checkpointKey derives the key authenticating checkpoints from the master
+// key and the digest of associated data `ad`, if any. Without associated data
+// the key is the one earlier checkpoints were made with.
+func checkpointKey(k *Key, ad []byte) []byte {
+	key := k.master()
+	defer clear(key[:])
+	m := hmac.New(sha256.New, key[:])
+	m.Write([]byte("cryptod checkpoint"))
+	if len(ad) != 0 {
+		digest := sha256.Sum256(ad)
+		m.Write(digest[:])
+	}
+	return m.Sum(nil)
+}
+
+// sum returns a MAC over `b` with a domain separating prefix
+func (ck *checkpointer) sum(prefix byte, b []byte) []byte {
+	m := hmac.New(sha256.New, ck.key)
+	m.Write([]byte{prefix})
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+// digest returns the keyed digest of the plaintext of a chunk, or nil if
+// checkpoints are disabled
+func (ck *checkpointer) digest(p []byte) []byte {
+	if ck == nil {
+		return nil
+	}
+	return ck.sum('d', p)
+}
+
+// save reports a checkpoint before chunk `ctr` to the hook
+func (ck *checkpointer) save(ctr uint64, in int64, out int64, digest []byte) error {
+	if ck == nil {
+		return nil
+	}
+	cp := &Checkpoint{
+		InputOffset:  in,
+		OutputOffset: out,
+		Chunk:        ctr,
+		decrypt:      ck.decrypt,
+		header:       ck.header,
+		digest:       digest,
+	}
+	cp.mac = ck.sum('c', cp.fields())
+	return ck.fn(cp)
+}
+
+// check authenticates checkpoint `cp` and returns the stream header it holds
+func (ck *checkpointer) check(cp *Checkpoint) (*header, error) {
+	if !hmac.Equal(cp.mac, ck.sum('c', cp.fields())) {
+		return nil, fmt.Errorf("%w: authentication failed", ErrBadCheckpoint)
+	}
+	if cp.decrypt != ck.decrypt {
+		return nil, fmt.Errorf("%w: checkpoint is for the other direction", ErrBadCheckpoint)
+	}
+	if cp.Chunk < 1 || cp.InputOffset < 0 || cp.OutputOffset < 0 {
+		return nil, fmt.Errorf("%w: malformed checkpoint", ErrBadCheckpoint)
+	}
+	h := &header{}
+	if err := h.read(bytes.NewReader(cp.header)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadCheckpoint, err)
+	}
+	return h, nil
+}
+
+// truncateOutput cuts `w` back to the output offset of `cp`
+func truncateOutput(w ResumableWriter, cp *Checkpoint) error {
+	size, err := w.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < cp.OutputOffset {
+		return fmt.Errorf("%w: output is shorter than the checkpoint", ErrBadCheckpoint)
+	}
+	if err := w.Truncate(cp.OutputOffset); err != nil {
+		return err
+	}
+	_, err = w.Seek(cp.OutputOffset, io.SeekStart)
+	return err
+}
+
+// ResumeEncrypt continues an Encrypt that was interrupted after saving
+// checkpoint `cp`, reading the same input `r` and appending to the partial
+// output `w`. The output is first truncated to the checkpoint, discarding any
+// partly written chunk. The result is exactly what an uninterrupted run would
+// have produced: the same stream header and per-stream state, chunk counters
+// continuing where they left off.
+//
+// The input must be unchanged: the next chunk is re-read and checked against
+// a digest in the checkpoint, and, as checkpoints may have been skipped, any
+// output written past the checkpoint is read back and checked against the
+// input encrypted again, before anything is written. Chunks there reuse
+// their nonces when resumed, so a changed input would seal other plaintext
+// under them. Otherwise ErrBadCheckpoint is returned. Output past the
+// checkpoint can only be checked if `w` is also an io.ReaderAt, such as an
+// *os.File; if not, it must end at the checkpoint. Options such as
+// WithCheckpoint apply as for Encrypt; WithFormat is ignored, the stream
+// keeps its format.
+func ResumeEncrypt(r io.ReadSeeker, w ResumableWriter, skey string, cp *Checkpoint, opts ...Option) error {
+	return ResumeEncryptContext(context.Background(), r, w, skey, cp, opts...)
+}
+
+// ResumeEncryptContext is like ResumeEncrypt but stops early when `ctx` is done.
+func ResumeEncryptContext(ctx context.Context, r io.ReadSeeker, w ResumableWriter, skey string, cp *Checkpoint, opts ...Option) error {
+	key := passphraseKey(skey)
+	defer key.Destroy()
+	return ResumeEncryptWithKeyContext(ctx, r, w, key, cp, opts...)
+}
+
+// ResumeEncryptWithKey is like ResumeEncrypt but takes the key as a Key.
+func ResumeEncryptWithKey(r io.ReadSeeker, w ResumableWriter, key *Key, cp *Checkpoint, opts ...Option) error {
+	return ResumeEncryptWithKeyContext(context.Background(), r, w, key, cp, opts...)
+}
+
+// ResumeEncryptWithKeyContext is like ResumeEncryptWithKey but stops early when
+// `ctx` is done.
+func ResumeEncryptWithKeyContext(ctx context.Context, r io.ReadSeeker, w ResumableWriter, key *Key, cp *Checkpoint, opts ...Option) error {
+	if err := key.check(); err != nil {
+		return streamError("encrypt", cp.Chunk, cp.OutputOffset, err)
+	}
+	o := newOptions(opts)
+	fail := func(err error) error {
+		return streamError("encrypt", cp.Chunk, cp.OutputOffset, err)
+	}
+	if o.armor {
+		return fail(errArmorCheckpoint)
+	}
+
+	verify := &checkpointer{key: checkpointKey(key, o.ad)}
+	h, err := verify.check(cp)
+	if err != nil {
+		return fail(err)
+	}
+	enc, err := newStreamEncoder(h, key, o)
+	if err != nil {
+		return fail(err)
+	}
+	if !bytes.Equal(enc.header().marshal(), cp.header) {
+		return fail(fmt.Errorf("%w: stream header mismatch", ErrBadCheckpoint))
+	}
+
+	// the next chunk must be the one the checkpoint was made for
+	if _, err := r.Seek(cp.InputOffset, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	src, err := newChunker(r, key, o)
+	if err != nil {
+		return fail(err)
+	}
+	pbuf := make([]byte, chunkSize)
+	defer clear(pbuf)
+	n, err := src.next(pbuf)
+	src.wipe()
+	if err != nil && err != io.EOF {
+		return fail(err)
+	}
+	if !hmac.Equal(verify.digest(pbuf[:n]), cp.digest) {
+		return fail(fmt.Errorf("%w: input changed since the checkpoint", ErrBadCheckpoint))
+	}
+	if err := checkWritten(ctx, r, w, h, key, o, cp); err != nil {
+		return fail(err)
+	}
+	if _, err := r.Seek(cp.InputOffset, io.SeekStart); err != nil {
+		return fail(err)
+	}
+
+	if err := truncateOutput(w, cp); err != nil {
+		return fail(err)
+	}
+	cw := &countingWriter{w: w, n: cp.OutputOffset}
+	t := newTracker(o, r, false, &cw.n)
+	t.chunks = cp.Chunk - 1
+	t.plain = cp.InputOffset
+	if t.total >= 0 && o.totalSize < 0 {
+		t.total += cp.InputOffset
+	}
+	if src, err = newChunker(r, key, o); err != nil {
+		return fail(err)
+	}
+	return encryptChunks(ctx, src, cw, enc, o, t, newCheckpointer(o, key, false, h))
+}
+
+var (
+	errMismatch = errors.New("output differs")
+	errCompared = errors.New("end of output reached")
+)
+
+// checkWritten checks that the output `w` holds past checkpoint `cp` is what
+// resuming from `cp` writes again. Checkpoints may be skipped, so chunks
+// there, whole or in part, were sealed with the nonces the resumed run uses:
+// sealing other input under them would reuse GCM nonces. The input is
+// encrypted again up to the end of the output, comparing instead of writing.
+// If `w` is not an io.ReaderAt, the output must end at the checkpoint.
+func checkWritten(ctx context.Context, r io.ReadSeeker, w ResumableWriter, h *header, key *Key, o *options, cp *Checkpoint) error {
+	size, err := w.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size <= cp.OutputOffset {
+		return nil
+	}
+	ra, ok := w.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("%w: output goes past the checkpoint and cannot be read back to check it", ErrBadCheckpoint)
+	}
+
+	enc, err := newStreamEncoder(h, key, o)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(cp.InputOffset, io.SeekStart); err != nil {
+		return err
+	}
+	src, err := newChunker(r, key, o)
+	if err != nil {
+		return err
+	}
+	vo := *o
+	vo.progress, vo.checkpoint = nil, nil
+	cmp := &compareWriter{r: io.NewSectionReader(ra, cp.OutputOffset, size-cp.OutputOffset), buf: make([]byte, 32*1024)}
+	cw := &countingWriter{w: cmp, n: cp.OutputOffset}
+	t := newTracker(&vo, r, false, &cw.n)
+	t.chunks = cp.Chunk - 1
+	t.plain = cp.InputOffset
+
+	err = encryptChunks(ctx, src, cw, enc, &vo, t, nil)
+	switch {
+	case err == nil && cmp.exhausted(), errors.Is(err, errCompared):
+		return nil
+	case err == nil, errors.Is(err, errMismatch):
+		return fmt.Errorf("%w: output past the checkpoint was encrypted from other input", ErrBadCheckpoint)
+	}
+	return err
+}
+
+// compareWriter compares what is written to it with `r`, failing with
+// errMismatch at the first difference and errCompared at the end of `r`
+type compareWriter struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (c *compareWriter) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		m, err := io.ReadFull(c.r, c.buf[:min(len(p)-n, len(c.buf))])
+		if !bytes.Equal(c.buf[:m], p[n:n+m]) {
+			return n, errMismatch
+		}
+		n += m
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, errCompared
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+// exhausted reports whether all of `r` was compared
+func (c *compareWriter) exhausted() bool {
+	_, err := c.r.Read(c.buf[:1])
+	return err == io.EOF
+}
+
+// ResumeDecrypt continues a Decrypt that was interrupted after saving
+// checkpoint `cp`, reading the same encrypted input `r` and appending to the
+// partial output `w`. The output is first truncated to the checkpoint. The
+// stream header of `r` must match the one recorded in the checkpoint.
+func ResumeDecrypt(r io.ReadSeeker, w ResumableWriter, skey string, cp *Checkpoint, opts ...Option) error {
+	return ResumeDecryptContext(context.Background(), r, w, skey, cp, opts...)
+}
+
+// ResumeDecryptContext is like ResumeDecrypt but stops early when `ctx` is done.
+func ResumeDecryptContext(ctx context.Context, r io.ReadSeeker, w ResumableWriter, skey string, cp *Checkpoint, opts ...Option) error {
+	key := passphraseKey(skey)
+	defer key.Destroy()
+	return ResumeDecryptWithKeyContext(ctx, r, w, key, cp, opts...)
+}
+
+// ResumeDecryptWithKey is like ResumeDecrypt but takes the key as a Key.
+func ResumeDecryptWithKey(r io.ReadSeeker, w ResumableWriter, key *Key, cp *Checkpoint, opts ...Option) error {
+	return ResumeDecryptWithKeyContext(context.Background(), r, w, key, cp, opts...)
+}
+
+// ResumeDecryptWithKeyContext is like ResumeDecryptWithKey but stops early when
+// `ctx` is done.
+func ResumeDecryptWithKeyContext(ctx context.Context, r io.ReadSeeker, w ResumableWriter, key *Key, cp *Checkpoint, opts ...Option) error {
+	if err := key.check(); err != nil {
+		return streamError("decrypt", cp.Chunk, cp.InputOffset, err)
+	}
+	o := newOptions(opts)
+	fail := func(err error) error {
+		return streamError("decrypt", cp.Chunk, cp.InputOffset, err)
+	}
+
+	verify := &checkpointer{key: checkpointKey(key, o.ad), decrypt: true}
+	h, err := verify.check(cp)
+	if err != nil {
+		return fail(err)
+	}
+
+	// the input must be the stream the checkpoint was made for
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	hr := &header{}
+	if err := hr.read(r); err != nil {
+		return streamError("decrypt", 0, 0, err)
+	}
+	if !bytes.Equal(hr.marshal(), cp.header) {
+		return fail(fmt.Errorf("%w: stream header mismatch", ErrBadCheckpoint))
+	}
+	dec, err := newStreamDecoder(h, key, o)
+	if err != nil {
+		return fail(err)
+	}
+	if err := truncateOutput(w, cp); err != nil {
+		return fail(err)
+	}
+	if _, err := r.Seek(cp.InputOffset, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	cr := &countingReader{r: r, n: cp.InputOffset}
+	t := newTracker(o, r, true, &cr.n)
+	t.chunks = cp.Chunk - 1
+	t.plain = cp.OutputOffset
+	if t.total >= 0 && o.totalSize < 0 {
+		t.total += cp.InputOffset
+	}
+	return decryptChunks(ctx, cr, w, dec, o, t, newCheckpointer(o, key, true, h))
+}
@@ -0,0 +1,263 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// collectCheckpoints returns an option saving every checkpoint, encoded, in `cps`
+func collectCheckpoints(t *testing.T, cps *[][]byte) Option {
+	return WithCheckpoint(func(cp *Checkpoint) error {
+		b, err := cp.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		*cps = append(*cps, b)
+		return nil
+	})
+}
+
+func loadCheckpoint(t *testing.T, b []byte) *Checkpoint {
+	cp := &Checkpoint{}
+	if err := cp.UnmarshalBinary(b); err != nil {
+		t.Fatalf("unmarshal checkpoint: %v", err)
+	}
+	return cp
+}
+
+// writeFile writes `b` to a new file in `dir` and returns it open for writing
+func writeFile(t *testing.T, dir string, name string, b []byte) *os.File {
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func readFile(t *testing.T, f *os.File) []byte {
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestResumeEncrypt(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize*4 + 100)
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			var cps [][]byte
+			buf := &bytes.Buffer{}
+			if err := Encrypt(bytes.NewReader(plaintext), buf, key, collectCheckpoints(t, &cps), WithConcurrency(workers)); err != nil {
+				t.Fatalf("encrypt error: %v", err)
+			}
+			full := buf.Bytes()
+			if len(cps) != 5 {
+				t.Fatalf("expected a checkpoint per chunk, got %d", len(cps))
+			}
+			cp := loadCheckpoint(t, cps[2])
+			if cp.Chunk != 3 || cp.InputOffset != 2*chunkSize {
+				t.Fatalf("unexpected checkpoint %+v", cp)
+			}
+
+			// interrupted part way through chunk 3
+			out := writeFile(t, t.TempDir(), "out", full[:cp.OutputOffset+500])
+			if err := ResumeEncrypt(bytes.NewReader(plaintext), out, key, cp, WithConcurrency(workers)); err != nil {
+				t.Fatalf("resume error: %v", err)
+			}
+			resumed := readFile(t, out)
+			if !bytes.Equal(resumed[:cp.OutputOffset], full[:cp.OutputOffset]) || len(resumed) != len(full) {
+				t.Errorf("resumed output does not continue the original")
+			}
+			dec := &bytes.Buffer{}
+			if err := Decrypt(bytes.NewReader(resumed), dec, key); err != nil {
+				t.Fatalf("decrypt error: %v", err)
+			}
+			if !bytes.Equal(dec.Bytes(), plaintext) {
+				t.Errorf("plaintext mismatch")
+			}
+
+			// later checkpoints were skipped: the output past the checkpoint
+			// is checked and rewritten, whether partial or complete
+			for _, end := range []int64{loadCheckpoint(t, cps[4]).OutputOffset + 10, int64(len(full))} {
+				out := writeFile(t, t.TempDir(), "out", full[:end])
+				if err := ResumeEncrypt(bytes.NewReader(plaintext), out, key, loadCheckpoint(t, cps[1]), WithConcurrency(workers)); err != nil {
+					t.Fatalf("resume with %d bytes written: %v", end, err)
+				}
+				if !bytes.Equal(readFile(t, out), full) {
+					t.Errorf("resume with %d bytes written: output differs", end)
+				}
+			}
+		})
+	}
+}
+
+// resumableBuffer is a ResumableWriter that cannot be read back
+type resumableBuffer struct {
+	b   []byte
+	off int64
+}
+
+func (rb *resumableBuffer) Write(p []byte) (int, error) {
+	rb.b = append(rb.b[:rb.off], p...)
+	rb.off += int64(len(p))
+	return len(p), nil
+}
+
+func (rb *resumableBuffer) Seek(off int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		off += int64(len(rb.b))
+	}
+	rb.off = off
+	return off, nil
+}
+
+func (rb *resumableBuffer) Truncate(size int64) error {
+	rb.b = rb.b[:size]
+	return nil
+}
+
+func TestResumeEncryptErrors(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize*3 + 100)
+	var cps [][]byte
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key, collectCheckpoints(t, &cps)); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	full := buf.Bytes()
+	cp := loadCheckpoint(t, cps[1])
+	dir := t.TempDir()
+
+	changed := append([]byte(nil), plaintext...)
+	changed[chunkSize+10]++
+	// changed in a chunk written after a skipped checkpoint
+	later := append([]byte(nil), plaintext...)
+	later[chunkSize*2+10]++
+	longer := append(append([]byte(nil), plaintext...), "more"...)
+	past := loadCheckpoint(t, cps[3]).OutputOffset
+	tampered := loadCheckpoint(t, cps[1])
+	tampered.Chunk = 1
+
+	tests := []struct {
+		name  string
+		input []byte
+		out   []byte
+		key   string
+		cp    *Checkpoint
+	}{
+		{"input changed", changed, full[:cp.OutputOffset], key, cp},
+		{"tampered checkpoint", plaintext, full[:cp.OutputOffset], key, tampered},
+		{"wrong key", plaintext, full[:cp.OutputOffset], "wrong key", cp},
+		{"output too short", plaintext, full[:cp.OutputOffset-1], key, cp},
+		{"input changed past the checkpoint", later, full[:past+10], key, cp},
+		{"input changed in a partly written chunk", later, full[:past-10], key, cp},
+		{"input grew after the end", longer, full, key, cp},
+	}
+	for _, tt := range tests {
+		out := writeFile(t, dir, "out", tt.out)
+		err := ResumeEncrypt(bytes.NewReader(tt.input), out, tt.key, tt.cp)
+		if !errors.Is(err, ErrBadCheckpoint) {
+			t.Errorf("%s: expected ErrBadCheckpoint, got %v", tt.name, err)
+		}
+		if got := readFile(t, out); !bytes.Equal(got, tt.out) {
+			t.Errorf("%s: output changed", tt.name)
+		}
+	}
+
+	// checkpoints are bound to the associated data
+	out := writeFile(t, dir, "out", full[:cp.OutputOffset])
+	if err := ResumeEncrypt(bytes.NewReader(plaintext), out, key, cp, WithAssociatedData([]byte("tenant"))); !errors.Is(err, ErrBadCheckpoint) {
+		t.Errorf("other associated data: expected ErrBadCheckpoint, got %v", err)
+	}
+
+	// output past the checkpoint that cannot be read back is not resumed
+	rb := &resumableBuffer{b: append([]byte(nil), full[:past]...)}
+	if err := ResumeEncrypt(bytes.NewReader(plaintext), rb, key, cp); !errors.Is(err, ErrBadCheckpoint) {
+		t.Errorf("unreadable output: expected ErrBadCheckpoint, got %v", err)
+	}
+	rb = &resumableBuffer{b: append([]byte(nil), full[:cp.OutputOffset]...)}
+	if err := ResumeEncrypt(bytes.NewReader(plaintext), rb, key, cp); err != nil || !bytes.Equal(rb.b, full) {
+		t.Errorf("unreadable output ending at the checkpoint: %v", err)
+	}
+
+	// decrypt checkpoints cannot resume encryption
+	var dcps [][]byte
+	if err := Decrypt(bytes.NewReader(full), &bytes.Buffer{}, key, collectCheckpoints(t, &dcps)); err != nil {
+		t.Fatal(err)
+	}
+	out = writeFile(t, dir, "out", full)
+	if err := ResumeEncrypt(bytes.NewReader(plaintext), out, key, loadCheckpoint(t, dcps[0])); !errors.Is(err, ErrBadCheckpoint) {
+		t.Errorf("expected ErrBadCheckpoint, got %v", err)
+	}
+}
+
+func TestResumeDecrypt(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize*4 + 100)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	data := buf.Bytes()
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			var cps [][]byte
+			if err := Decrypt(bytes.NewReader(data), &bytes.Buffer{}, key, collectCheckpoints(t, &cps), WithConcurrency(workers)); err != nil {
+				t.Fatalf("decrypt error: %v", err)
+			}
+			if len(cps) != 5 {
+				t.Fatalf("expected a checkpoint per chunk, got %d", len(cps))
+			}
+			cp := loadCheckpoint(t, cps[1])
+			if cp.Chunk != 3 || cp.OutputOffset != 2*chunkSize {
+				t.Fatalf("unexpected checkpoint %+v", cp)
+			}
+
+			out := writeFile(t, t.TempDir(), "out", plaintext[:cp.OutputOffset+500])
+			if err := ResumeDecrypt(bytes.NewReader(data), out, key, cp, WithConcurrency(workers)); err != nil {
+				t.Fatalf("resume error: %v", err)
+			}
+			if !bytes.Equal(readFile(t, out), plaintext) {
+				t.Errorf("plaintext mismatch")
+			}
+
+			// the input must still start with a valid header
+			other := append([]byte(nil), data...)
+			other[1] = 'x'
+			out = writeFile(t, t.TempDir(), "out", plaintext[:cp.OutputOffset])
+			if err := ResumeDecrypt(bytes.NewReader(other), out, key, cp); !errors.Is(err, ErrBadHeader) {
+				t.Errorf("expected ErrBadHeader, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckpointMarshal(t *testing.T) {
+	var cps [][]byte
+	if err := Encrypt(bytes.NewReader(generatePlainText(100)), &bytes.Buffer{}, "key", collectCheckpoints(t, &cps)); err != nil {
+		t.Fatal(err)
+	}
+	cp := loadCheckpoint(t, cps[0])
+	b, err := cp.MarshalBinary()
+	if err != nil || !bytes.Equal(b, cps[0]) {
+		t.Errorf("round trip mismatch: %v", err)
+	}
+	for i := range b {
+		if err := (&Checkpoint{}).UnmarshalBinary(b[:i]); !errors.Is(err, ErrBadCheckpoint) {
+			t.Errorf("truncated to %d bytes: expected ErrBadCheckpoint, got %v", i, err)
+		}
+	}
+}
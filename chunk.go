@@ -1,9 +1,7 @@
 package cryptod
 
 import (
-	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 )
@@ -12,6 +10,11 @@ const (
 	chunkTag      = "ct"
 	chunkTypeData = "d"
 	chunkTypeTomb = "t"
+
+	maxNonceSize = 128
+
+	// largest possible chunk header
+	maxChunkHeaderSize = len(chunkTag)*2 + len(chunkTypeData) + binary.MaxVarintLen16 + maxNonceSize + binary.MaxVarintLen32
 )
 
 type chunkHeader struct {
@@ -22,111 +25,86 @@ type chunkHeader struct {
 
 // writes a chunk header, containing the tag id, nonce and chunk size
 func writeChunkHeader(ch chunkHeader, w io.Writer) error {
-	// write the tag (open)
-	tag := []byte(chunkTag)
-	if _, err := w.Write(tag); err != nil {
-		return err
-	}
+	_, err := w.Write(appendChunkHeader(nil, ch))
+	return err
+}
 
-	// write the chunk type
-	var t []byte
+// appendChunkHeader appends the encoded chunk header `ch` to `b`. With room
+// for maxChunkHeaderSize bytes in `b` it does not allocate.
+func appendChunkHeader(b []byte, ch chunkHeader) []byte {
+	// the tag (open) and chunk type
+	b = append(b, chunkTag...)
 	if ch.tomb {
-		t = []byte(chunkTypeTomb)
+		b = append(b, chunkTypeTomb...)
 	} else {
-		t = []byte(chunkTypeData)
-	}
-	if _, err := w.Write(t); err != nil {
-		return err
+		b = append(b, chunkTypeData...)
 	}
 
-	// write the nonce size, followed by nonce
-	sizeNonce := make([]byte, binary.MaxVarintLen16)
-	binary.PutUvarint(sizeNonce, uint64(len(ch.nonce)))
-	if _, err := w.Write(sizeNonce); err != nil {
-		return err
-	}
-	if _, err := w.Write(ch.nonce); err != nil {
-		return err
-	}
+	// the nonce size, followed by nonce, then the chunk size; the sizes are
+	// uvarints padded to their maximum length
+	b = append(b, make([]byte, binary.MaxVarintLen16)...)
+	binary.PutUvarint(b[len(b)-binary.MaxVarintLen16:], uint64(len(ch.nonce)))
+	b = append(b, ch.nonce...)
+	b = append(b, make([]byte, binary.MaxVarintLen32)...)
+	binary.PutUvarint(b[len(b)-binary.MaxVarintLen32:], uint64(ch.size))
 
-	// write the chunk size
-	sizeChunk := make([]byte, binary.MaxVarintLen32)
-	binary.PutUvarint(sizeChunk, uint64(ch.size))
-	if _, err := w.Write(sizeChunk); err != nil {
-		return err
-	}
-
-	// write the tag (close)
-	if _, err := w.Write(tag); err != nil {
-		return err
-	}
-	return nil
+	// the tag (close)
+	return append(b, chunkTag...)
 }
 
-// reads a chunk header
-func readChunkHeader(r io.Reader, maxChunkSize int) (chunkHeader, error) {
+// reads a chunk header. Its nonce is read into `buf`, which is allocated if
+// it has less than maxChunkHeaderSize bytes, and is only valid until `buf` is
+// reused.
+func readChunkHeader(r io.Reader, buf []byte, maxChunkSize int) (chunkHeader, error) {
 	h := chunkHeader{}
-
-	// read the tag (open)
-	taglen := len(chunkTag)
-	tag := make([]byte, taglen)
-	if _, err := r.Read(tag); err != nil {
-		return h, err
-	}
-	if !bytes.Equal(tag, []byte(chunkTag)) {
-		return h, errors.New("invalid chunk header tag (open)")
+	if cap(buf) < maxChunkHeaderSize {
+		buf = make([]byte, maxChunkHeaderSize)
 	}
 
-	// read the chunk type
-	t := []byte(chunkTypeData)
-	if _, err := r.Read(t); err != nil {
-		return h, err
-	}
-	if bytes.Equal(t, []byte(chunkTypeTomb)) {
+	// read the tag (open), chunk type and nonce size
+	const fixed = len(chunkTag) + len(chunkTypeData) + binary.MaxVarintLen16
+	b := buf[:fixed]
+	if _, err := io.ReadFull(r, b); err != nil {
+		return h, truncated(err)
+	}
+	if string(b[:len(chunkTag)]) != chunkTag {
+		return h, fmt.Errorf("%w: invalid chunk header tag (open)", ErrBadChunk)
+	}
+	b = b[len(chunkTag):]
+	switch string(b[:len(chunkTypeData)]) {
+	case chunkTypeData:
+	case chunkTypeTomb:
 		h.tomb = true
+	default:
+		return h, fmt.Errorf("%w: invalid chunk type %q", ErrBadChunk, b[:len(chunkTypeData)])
 	}
-
-	// read nonce size
-	sizeNonce := make([]byte, binary.MaxVarintLen16)
-	if _, err := r.Read(sizeNonce); err != nil {
-		return h, err
-	}
-	val, err := binary.ReadUvarint(bytes.NewReader(sizeNonce))
-	if err != nil {
-		return h, err
+	b = b[len(chunkTypeData):]
+	val, n := binary.Uvarint(b)
+	if n <= 0 {
+		return h, fmt.Errorf("%w: invalid nonce size", ErrBadChunk)
 	}
-	size := uint32(val)
-	if size > 128 { // sanity check
-		return h, fmt.Errorf("invalid nonce size: %d", size)
+	if val > maxNonceSize { // sanity check
+		return h, fmt.Errorf("%w: invalid nonce size: %d", ErrBadChunk, val)
 	}
+	size := int(val)
 
-	// read nonce
-	h.nonce = make([]byte, size)
-	if _, err := r.Read(h.nonce); err != nil {
-		return h, err
+	// read the nonce, chunk size and tag (close)
+	b = buf[fixed : fixed+size+binary.MaxVarintLen32+len(chunkTag)]
+	if _, err := io.ReadFull(r, b); err != nil {
+		return h, truncated(err)
 	}
-
-	// read chunk size
-	sizeChunk := make([]byte, binary.MaxVarintLen32)
-	if _, err := r.Read(sizeChunk); err != nil {
-		return h, err
+	h.nonce = b[:size:size]
+	b = b[size:]
+	val, n = binary.Uvarint(b[:binary.MaxVarintLen32])
+	if n <= 0 {
+		return h, fmt.Errorf("%w: invalid chunk size", ErrBadChunk)
 	}
-	val, err = binary.ReadUvarint(bytes.NewReader(sizeChunk))
-	if err != nil {
-		return h, err
+	if val > uint64(maxChunkSize) {
+		return h, fmt.Errorf("%w: invalid chunk size: %d, max=%d", ErrBadChunk, val, maxChunkSize)
 	}
 	h.size = uint32(val)
-	if h.size > uint32(maxChunkSize) {
-		return h, fmt.Errorf("invalid chunk size: %d, max=%d", h.size, maxChunkSize)
-	}
-
-	// read the tag (close)
-	tag = make([]byte, taglen)
-	if _, err := r.Read(tag); err != nil {
-		return h, err
-	}
-	if !bytes.Equal(tag, []byte(chunkTag)) {
-		return h, errors.New("invalid chunk header tag (close)")
+	if string(b[binary.MaxVarintLen32:]) != chunkTag {
+		return h, fmt.Errorf("%w: invalid chunk header tag (close)", ErrBadChunk)
 	}
 	// header ok
 	return h, nil
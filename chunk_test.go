@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func TestReadWriteChunkHeader(t *testing.T) {
@@ -23,7 +24,7 @@ func TestReadWriteChunkHeader(t *testing.T) {
 	// read header back from buffer
 	var h2 chunkHeader
 	var err error
-	if h2, err = readChunkHeader(buf, chunkSize); err != nil {
+	if h2, err = readChunkHeader(buf, nil, chunkSize); err != nil {
 		t.Error("error on read: ", err)
 	}
 
@@ -32,6 +33,28 @@ func TestReadWriteChunkHeader(t *testing.T) {
 	}
 }
 
+func TestReadChunkHeaderShortReads(t *testing.T) {
+	h := chunkHeader{nonce: []byte("123456789012"), size: chunkSize}
+
+	for name, wrap := range map[string]func(io.Reader) io.Reader{
+		"OneByteReader": iotest.OneByteReader,
+		"HalfReader":    iotest.HalfReader,
+	} {
+		buf := &bytes.Buffer{}
+		if err := writeChunkHeader(h, buf); err != nil {
+			t.Error("error on write: ", err)
+		}
+
+		h2, err := readChunkHeader(wrap(buf), nil, chunkSize)
+		if err != nil {
+			t.Errorf("%s: error on read: %v", name, err)
+		}
+		if err := compareChunkHeader(h, h2); err != nil {
+			t.Errorf("%s: error on compare: %v", name, err)
+		}
+	}
+}
+
 func TestReadChunkHeaderGibberish(t *testing.T) {
 	// create random input data
 	buf := make([]byte, chunkSize*2)
@@ -41,7 +64,7 @@ func TestReadChunkHeaderGibberish(t *testing.T) {
 	}
 	r := bytes.NewReader(buf)
 
-	if _, err := readChunkHeader(r, chunkSize); err == nil {
+	if _, err := readChunkHeader(r, nil, chunkSize); err == nil {
 		t.Error("expected error")
 	}
 }
@@ -63,7 +86,7 @@ func TestTombChunkHeader(t *testing.T) {
 	// read tomb chunk header back from buffer
 	var h2 chunkHeader
 	var err error
-	if h2, err = readChunkHeader(buf, chunkSize); err != nil && !h2.tomb {
+	if h2, err = readChunkHeader(buf, nil, chunkSize); err != nil && !h2.tomb {
 		t.Error("error on read: ", err)
 	}
 
@@ -101,7 +124,7 @@ func TestChunkHeaderWithLargeNonce(t *testing.T) {
 
 	var h2 chunkHeader
 	var err error
-	if h2, err = readChunkHeader(buf, chunkSize*2); err != nil {
+	if h2, err = readChunkHeader(buf, nil, chunkSize*2); err != nil {
 		t.Error("error on read: ", err)
 	}
 
@@ -127,7 +150,7 @@ func TestChunkHeaderInvalidNonceSize(t *testing.T) {
 	buf.Write(sizeNonce)
 
 	// Try to read it - should fail with nonce size validation
-	_, err := readChunkHeader(buf, chunkSize)
+	_, err := readChunkHeader(buf, nil, chunkSize)
 	if err == nil {
 		t.Error("expected error for oversized nonce, got none")
 	}
@@ -0,0 +1,198 @@
+package cryptod
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Default content-defined chunk sizes, see WithContentDefinedChunking
+const (
+	DefaultMinChunkSize = 256 * 1024
+	DefaultAvgChunkSize = 512 * 1024
+	DefaultMaxChunkSize = chunkSize
+
+	minCDCChunkSize = 64 // smallest min accepted, keeps the rolling hash window filled
+)
+
+// chunking holds the content-defined chunk sizes chosen with
+// WithContentDefinedChunking
+type chunking struct {
+	min, avg, max int
+}
+
+// WithContentDefinedChunking makes Encrypt cut chunks where the content says
+// rather than every 1,024,000 bytes. Boundaries are found with FastCDC, a
+// rolling gear hash with normalized chunking: no chunk is shorter than `min`
+// (except the last) or longer than `max`, and chunks average about `avg`
+// bytes. Inserting or deleting bytes then only changes the chunks around the
+// edit, and the unchanged regions of successive backups are cut into the same
+// chunks, which a store encrypting each chunk deterministically can
+// deduplicate. A zero size picks the default, and `max` may not exceed
+// 1,024,000 bytes so any reader can decrypt the stream.
+//
+// The gear table is derived from the key, so chunk sizes, which are visible
+// in the stream, don't reveal content to anyone without the key. Resuming
+// from a checkpoint needs the same chunk sizes.
+func WithContentDefinedChunking(min, avg, max int) Option {
+	return func(o *options) {
+		o.chunking = &chunking{min: min, avg: avg, max: max}
+	}
+}
+
+// chunker splits plaintext into chunks
+type chunker interface {
+	// next fills `p`, which holds at least chunkSize bytes, with the next
+	// chunk and returns its size. At the end of the input it returns io.EOF
+	// with the last, possibly empty, chunk.
+	next(p []byte) (int, error)
+	// wipe clears any plaintext the chunker holds
+	wipe()
+}
+
+// newChunker returns the chunker for `r` selected by `o`
+func newChunker(r io.Reader, key *Key, o *options) (chunker, error) {
+	if o.chunking == nil {
+		return fixedChunker{r: r}, nil
+	}
+	c := *o.chunking
+	if c.min == 0 {
+		c.min = DefaultMinChunkSize
+	}
+	if c.avg == 0 {
+		c.avg = DefaultAvgChunkSize
+	}
+	if c.max == 0 {
+		c.max = DefaultMaxChunkSize
+	}
+	if c.min < minCDCChunkSize || c.min > c.avg || c.avg > c.max || c.max > chunkSize {
+		return nil, fmt.Errorf("invalid chunk sizes: min=%d avg=%d max=%d", c.min, c.avg, c.max)
+	}
+	gear, err := gearTable(key)
+	if err != nil {
+		return nil, err
+	}
+	return newCDCChunker(r, c, gear, o.bufs), nil
+}
+
+// fixedChunker cuts full-sized chunks
+type fixedChunker struct {
+	r io.Reader
+}
+
+func (c fixedChunker) next(p []byte) (int, error) {
+	return fillChunk(c.r, p[:chunkSize])
+}
+
+func (c fixedChunker) wipe() {}
+
+// cdcChunker cuts content-defined chunks with FastCDC
+type cdcChunker struct {
+	r     io.Reader
+	c     chunking
+	gear  *[256]uint64
+	maskS uint64 // harder to match, used before the average size
+	maskL uint64 // easier to match, used after it
+
+	buf  []byte // read ahead, up to one maximum sized chunk
+	n    int    // bytes in buf
+	eof  bool
+	bufs *bufferPool // buf is returned to it by wipe
+}
+
+func newCDCChunker(r io.Reader, c chunking, gear *[256]uint64, bufs *bufferPool) *cdcChunker {
+	// normalized chunking: shift the mask by two bits either side of the
+	// average, using the high bits, which depend on the last 64 bytes
+	b := bits.Len(uint(c.avg)) - 1
+	return &cdcChunker{
+		r:     r,
+		c:     c,
+		gear:  gear,
+		maskS: highBits(b + 2),
+		maskL: highBits(max(b-2, 1)),
+		buf:   bufs.get(c.max),
+		bufs:  bufs,
+	}
+}
+
+// highBits returns a mask of the `n` highest bits
+func highBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+func (c *cdcChunker) next(p []byte) (int, error) {
+	if !c.eof && c.n < len(c.buf) {
+		n, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += n
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return 0, err
+		}
+	}
+	cut := c.cut(c.buf[:c.n])
+	copy(p, c.buf[:cut])
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	if c.eof && c.n == 0 {
+		return cut, io.EOF
+	}
+	return cut, nil
+}
+
+func (c *cdcChunker) wipe() {
+	c.bufs.put(c.buf)
+	c.buf = nil
+}
+
+// cut returns the size of the chunk at the start of `b`, which holds a
+// maximum sized chunk unless the input ended
+func (c *cdcChunker) cut(b []byte) int {
+	n := len(b)
+	if n <= c.c.min {
+		return n
+	}
+	normal := min(c.c.avg, n)
+	var fp uint64
+	i := c.c.min
+	for ; i < normal; i++ {
+		fp = fp<<1 + c.gear[b[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + c.gear[b[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// gearTable returns the rolling hash table for `key`, derived once per Key.
+// It is shared, so it must not be modified.
+func gearTable(key *Key) (*[256]uint64, error) {
+	return cached(key, func(d *derivedKeys) **[256]uint64 { return &d.gear }, func() (*[256]uint64, error) {
+		return deriveGearTable(key)
+	})
+}
+
+// deriveGearTable derives the rolling hash table for `key`
+func deriveGearTable(key *Key) (*[256]uint64, error) {
+	master := key.master()
+	defer clear(master[:])
+	b, err := hkdf.Key(sha256.New, master[:], nil, "cryptod gear table", 256*8)
+	if err != nil {
+		return nil, err
+	}
+	var gear [256]uint64
+	for i := range gear {
+		gear[i] = binary.LittleEndian.Uint64(b[i*8:])
+	}
+	return &gear, nil
+}
@@ -0,0 +1,223 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// randomText returns `size` pseudo-random bytes, the same for each seed
+func randomText(seed int64, size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func TestContentDefinedChunking(t *testing.T) {
+	const key = "secret key"
+	const minSize, avgSize, maxSize = 16 * 1024, 64 * 1024, 256 * 1024
+	plaintext := randomText(1, 8*1024*1024)
+	cdc := WithContentDefinedChunking(minSize, avgSize, maxSize)
+
+	for _, workers := range []int{1, 4} {
+		buf := &bytes.Buffer{}
+		if err := Encrypt(bytes.NewReader(plaintext), buf, key, cdc, WithConcurrency(workers)); err != nil {
+			t.Fatalf("workers=%d: encrypt error: %v", workers, err)
+		}
+		data := buf.Bytes()
+
+		info, err := Inspect(bytes.NewReader(data))
+		if err != nil || !info.ContentDefined {
+			t.Fatalf("workers=%d: expected content-defined chunks: %v, %+v", workers, err, info)
+		}
+		for i, c := range info.Chunks {
+			n := c.Size - 16
+			if n > maxSize || (n < minSize && i < len(info.Chunks)-1) {
+				t.Errorf("workers=%d: chunk %d has %d bytes", workers, i+1, n)
+			}
+		}
+		avg := len(plaintext) / len(info.Chunks)
+		if avg < avgSize/2 || avg > avgSize*2 {
+			t.Errorf("workers=%d: average chunk size %d, expected about %d", workers, avg, avgSize)
+		}
+
+		out := &bytes.Buffer{}
+		if err := Decrypt(bytes.NewReader(data), out, key, WithConcurrency(workers)); err != nil {
+			t.Fatalf("workers=%d: decrypt error: %v", workers, err)
+		}
+		if !bytes.Equal(plaintext, out.Bytes()) {
+			t.Errorf("workers=%d: plaintext mismatch", workers)
+		}
+	}
+
+	// lost chunks have unknown sizes, so they are not zero filled
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key, cdc); err != nil {
+		t.Fatal(err)
+	}
+	damaged := buf.Bytes()
+	damaged[len(damaged)/2] ^= 1
+	report, err := Recover(bytes.NewReader(damaged), io.Discard, key, WithZeroFill())
+	if err != nil || len(report.Lost) != 1 || report.Lost[0].PlaintextSize != -1 {
+		t.Errorf("recover: unexpected result %v, %+v", err, report)
+	}
+}
+
+func TestContentDefinedChunkingShift(t *testing.T) {
+	plaintext := randomText(2, 4*1024*1024)
+	edited := append(append(append([]byte(nil), plaintext[:1000]...), 'x'), plaintext[1000:]...)
+	o := newOptions([]Option{WithContentDefinedChunking(16*1024, 64*1024, 256*1024)})
+
+	chunks := func(p []byte) []string {
+		src, err := newChunker(bytes.NewReader(p), NewKey([]byte("secret key")), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var chunks []string
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := src.next(buf)
+			if n > 0 {
+				chunks = append(chunks, string(buf[:n]))
+			}
+			if err == io.EOF {
+				return chunks
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the boundaries resynchronize after the inserted byte, so only the
+	// chunks around it change
+	before, after := chunks(plaintext), chunks(edited)
+	if len(before) < 20 {
+		t.Fatalf("expected more chunks, got %d", len(before))
+	}
+	seen := make(map[string]bool)
+	for _, c := range before {
+		seen[c] = true
+	}
+	changed := 0
+	for _, c := range after {
+		if !seen[c] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed after inserting one byte", changed, len(after))
+	}
+
+	// another key cuts elsewhere
+	other, err := newChunker(bytes.NewReader(plaintext), NewKey([]byte("other key")), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, chunkSize)
+	if n, _ := other.next(buf); n == len(before[0]) {
+		t.Error("chunk boundaries don't depend on the key")
+	}
+}
+
+// deterministic streams with content-defined chunks address chunks by content,
+// so the chunks an edit leaves alone have the same ciphertext in both versions
+func TestDeterministicContentDefined(t *testing.T) {
+	const key = "secret key"
+	opts := []Option{WithDeterministic(), WithContentDefinedChunking(16*1024, 64*1024, 256*1024)}
+	plaintext := randomText(3, 4*1024*1024)
+	edited := append(append(append([]byte(nil), plaintext[:1000]...), "inserted"...), plaintext[1000:]...)
+	edited = append(edited[:3*1024*1024], edited[3*1024*1024+500:]...)
+
+	encrypt := func(p []byte, workers int) []byte {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		if err := Encrypt(bytes.NewReader(p), buf, key, append(opts, WithConcurrency(workers))...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	data, data2 := encrypt(plaintext, 1), encrypt(edited, 4)
+	before, header, tomb := parseEncryptedStream(t, data)
+	after, _, _ := parseEncryptedStream(t, data2)
+	seen := make(map[string]bool)
+	for _, c := range before {
+		seen[string(c)] = true
+	}
+	changed := 0
+	for _, c := range after {
+		if !seen[string(c)] {
+			changed++
+		}
+	}
+	if len(before) < 20 || changed > 4 {
+		t.Errorf("%d of %d chunk frames changed after two edits", changed, len(after))
+	}
+	if info, err := Inspect(bytes.NewReader(data)); err != nil || !info.Deterministic || !info.ContentDefined {
+		t.Errorf("inspect: %v, %+v", err, info)
+	}
+	for _, workers := range []int{1, 4} {
+		out := &bytes.Buffer{}
+		if err := Decrypt(bytes.NewReader(data2), out, key, WithConcurrency(workers)); err != nil || !bytes.Equal(out.Bytes(), edited) {
+			t.Errorf("workers=%d: decrypt error: %v", workers, err)
+		}
+	}
+
+	// chunks authenticate wherever they are, so the end marker catches
+	// reordered, dropped and repeated chunks
+	assemble := func(chunks ...[]byte) []byte {
+		return bytes.Join(append(append([][]byte{header}, chunks...), tomb), nil)
+	}
+	swapped := append([][]byte(nil), before...)
+	swapped[2], swapped[3] = swapped[3], swapped[2]
+	for name, stream := range map[string][]byte{
+		"swapped":  assemble(swapped...),
+		"dropped":  assemble(append(append([][]byte(nil), before[:5]...), before[6:]...)...),
+		"repeated": assemble(append(append([][]byte(nil), before[:5]...), before[4:]...)...),
+	} {
+		for _, workers := range []int{1, 4} {
+			if err := Decrypt(bytes.NewReader(stream), io.Discard, key, WithConcurrency(workers)); !errors.Is(err, ErrAuthentication) {
+				t.Errorf("%s, workers=%d: expected ErrAuthentication, got %v", name, workers, err)
+			}
+		}
+	}
+
+	// the order accumulator is not in checkpoints
+	cp := WithCheckpoint(func(*Checkpoint) error { return nil })
+	if err := Encrypt(bytes.NewReader(plaintext), io.Discard, key, append(opts, cp)...); !errors.Is(err, errDeterministicCheckpoint) {
+		t.Errorf("encrypt with checkpoints: expected errDeterministicCheckpoint, got %v", err)
+	}
+	if err := Decrypt(bytes.NewReader(data), io.Discard, key, cp); !errors.Is(err, errDeterministicCheckpoint) {
+		t.Errorf("decrypt with checkpoints: expected errDeterministicCheckpoint, got %v", err)
+	}
+}
+
+func TestContentDefinedChunkingOptions(t *testing.T) {
+	plaintext := []byte("data")
+	for _, sizes := range [][3]int{
+		{32, 64, 128},                      // min too small
+		{64 * 1024, 32 * 1024, 128 * 1024}, // min above avg
+		{64 * 1024, 128 * 1024, 64 * 1024}, // avg above max
+		{0, 0, chunkSize + 1},              // max too large
+	} {
+		err := Encrypt(bytes.NewReader(plaintext), io.Discard, "key", WithContentDefinedChunking(sizes[0], sizes[1], sizes[2]))
+		if err == nil {
+			t.Errorf("sizes %v: expected an error", sizes)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, "key", WithContentDefinedChunking(0, 0, 0)); err != nil {
+		t.Fatalf("default sizes: %v", err)
+	}
+	if err := Decrypt(buf, io.Discard, "key"); err != nil {
+		t.Errorf("default sizes: decrypt error: %v", err)
+	}
+
+	err := Encrypt(bytes.NewReader(plaintext), io.Discard, "key", WithContentDefinedChunking(0, 0, 0), WithFormat(FormatV1))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("format 1.0: expected ErrUnsupportedVersion, got %v", err)
+	}
+}
@@ -1,11 +1,9 @@
 package cryptod
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha512"
-	"encoding/binary"
 	"fmt"
 	"io"
 )
@@ -17,131 +15,394 @@ const (
 // Encrypt reads chunks of data from `r` writes the encrypted contents to `w`
 // based on the specified key. Reading continues until io.EOF.
 //
-// The key should be unique for each io.Reader instance.
-// For example, when encrypting files `skey` can be a secret plus the filespec
-// to ensure the key is unique for each file.
+// Each stream gets its own key, derived from `skey` and a random salt, so one
+// key can safely encrypt many streams. To give each file a key of its own,
+// derive it with KeyForPath rather than appending the path to a secret.
 //
 // Uses AES256 encryption and GCM authentication on chunks of size up to 1MB.
-func Encrypt(r io.Reader, w io.Writer, skey string) error {
-	gcm, err := getGCM(skey)
+// Every chunk but the last is full-sized, however `r` delivers its bytes,
+// unless WithContentDefinedChunking is given.
+func Encrypt(r io.Reader, w io.Writer, skey string, opts ...Option) error {
+	return EncryptContext(context.Background(), r, w, skey, opts...)
+}
+
+// EncryptContext is like Encrypt but stops early when `ctx` is done.
+//
+// The context is checked between chunks, so a blocked read or write is not
+// interrupted. When cancelled, the returned error wraps ctx.Err() and reports
+// the number of plaintext bytes encrypted so far.
+func EncryptContext(ctx context.Context, r io.Reader, w io.Writer, skey string, opts ...Option) error {
+	key := passphraseKey(skey)
+	defer key.Destroy()
+	return EncryptWithKeyContext(ctx, r, w, key, opts...)
+}
+
+// EncryptWithKey is like Encrypt but takes the key as a Key, which can be
+// wiped from memory once done with.
+func EncryptWithKey(r io.Reader, w io.Writer, key *Key, opts ...Option) error {
+	return EncryptWithKeyContext(context.Background(), r, w, key, opts...)
+}
+
+// EncryptWithKeyContext is like EncryptWithKey but stops early when `ctx` is
+// done, as EncryptContext does.
+func EncryptWithKeyContext(ctx context.Context, r io.Reader, w io.Writer, key *Key, opts ...Option) error {
+	_, err := encryptStream(ctx, r, w, key, newOptions(opts))
+	return err
+}
+
+// encryptStream encrypts `r` to `w` as a new stream, returning the tracker
+// counting what was encrypted once the stream is under way
+func encryptStream(ctx context.Context, r io.Reader, w io.Writer, key *Key, o *options) (*tracker, error) {
+	if err := key.check(); err != nil {
+		return nil, streamError("encrypt", 0, 0, err)
+	}
+	enc, err := newStreamEncoder(nil, key, o)
 	if err != nil {
-		return err
+		return nil, streamError("encrypt", 0, 0, err)
 	}
 
-	// reuse buffers to reduce GC
-	pbuf := make([]byte, chunkSize)
-	nonce := make([]byte, gcm.NonceSize())
-	cbuf := make([]byte, len(pbuf)+gcm.Overhead())
-	var ctr uint32 = 1
+	var aw *armorWriter
+	if o.armor {
+		if o.checkpoint != nil {
+			return nil, streamError("encrypt", 0, 0, errArmorCheckpoint)
+		}
+		if aw, err = newArmorWriter(w, o.armorComment); err != nil {
+			return nil, streamError("encrypt", 0, 0, err)
+		}
+		w = aw
+	}
+	cw := &countingWriter{w: w}
+	t := newTracker(o, r, false, &cw.n)
+
+	src, err := newChunker(r, key, o)
+	if err != nil {
+		return nil, streamError("encrypt", 0, 0, err)
+	}
 
 	// write the stream header
-	if err = writeHeader(w); err != nil {
+	h := enc.header()
+	if err = h.write(cw); err != nil {
+		return t, streamError("encrypt", 0, 0, err)
+	}
+	if err := encryptChunks(ctx, src, cw, enc, o, t, newCheckpointer(o, key, false, h)); err != nil {
+		return t, err
+	}
+	if aw != nil {
+		if err := aw.Close(); err != nil {
+			return t, streamError("encrypt", t.chunks+1, *t.cipher, err)
+		}
+	}
+	return t, nil
+}
+
+// encryptChunks encrypts the chunks of `src` to `w` after the stream header,
+// continuing from the chunk after those counted in `t`, and ends the stream.
+func encryptChunks(ctx context.Context, src chunker, w io.Writer, enc encoder, o *options, t *tracker, ck *checkpointer) error {
+	defer src.wipe()
+	var err error
+	if o.concurrency > 1 {
+		err = encryptParallel(ctx, src, w, enc, o, t, ck)
+	} else {
+		err = encryptSequential(ctx, src, w, enc, o.bufs, t, ck)
+	}
+	if err != nil {
 		return err
 	}
 
+	// write the tomb chunk
+	off := *t.cipher
+	nonce := make([]byte, enc.nonceSize())
+	c, err := enc.sealTomb(nil, nonce, t.chunks+1)
+	if err != nil {
+		return streamError("encrypt", t.chunks+1, off, err)
+	}
+	if err := writeChunkHeader(chunkHeader{nonce: nonce, size: uint32(len(c)), tomb: true}, w); err != nil {
+		return streamError("encrypt", t.chunks+1, off, err)
+	}
+	if _, err := w.Write(c); err != nil {
+		return streamError("encrypt", t.chunks+1, off, err)
+	}
+	t.done()
+	return nil
+}
+
+// encryptSequential encrypts the chunks of `src` one at a time on the calling goroutine
+func encryptSequential(ctx context.Context, src chunker, w io.Writer, enc encoder, bufs *bufferPool, t *tracker, ck *checkpointer) error {
+	// reuse buffers to reduce GC; put clears the part that was used
+	pbuf := bufs.get(chunkSize)
+	nonce := make([]byte, enc.nonceSize())
+	hbuf := make([]byte, 0, maxChunkHeaderSize)
+	cbuf := bufs.get(len(pbuf) + enc.overhead())
+	used := 0
+	defer func() {
+		bufs.put(pbuf[:used])
+		bufs.put(cbuf[:min(used+enc.overhead(), len(cbuf))])
+	}()
+	ctr := t.chunks + 1
+
 	for {
-		n, readErr := r.Read(pbuf)
+		off := *t.cipher
+		if err := ctx.Err(); err != nil {
+			return streamError("encrypt", ctr, off, cancelled("encrypt", t.plain, err))
+		}
+		n, readErr := src.next(pbuf)
+		used = max(used, n)
 		if n > 0 {
-			p := pbuf[:n]
-			// randomize the nonce
-			if _, err := io.ReadFull(rand.Reader, nonce[binary.MaxVarintLen32:]); err != nil {
-				return err
+			if err := ck.save(ctr, t.plain, off, ck.digest(pbuf[:n])); err != nil {
+				return streamError("encrypt", ctr, off, err)
 			}
-			binary.PutUvarint(nonce, uint64(ctr))
-			// create AAD with chunk counter to authenticate chunk sequence
-			aad := make([]byte, 4)
-			binary.LittleEndian.PutUint32(aad, ctr)
-			ctr++
-			// encrypt and authenticate with AAD binding chunk counter
-			c := gcm.Seal(cbuf[:0], nonce, p, aad)
-			var clen = uint32(len(c))
-			if clen > 0 {
-				// write a chunk header containing actual encrypted block size
-				if err := writeChunkHeader(chunkHeader{nonce: nonce, size: clen}, w); err != nil {
-					return err
-				}
-				// write encrypted data to output steam
-				if _, err := w.Write(c); err != nil {
-					return err
-				}
+			c, err := enc.seal(cbuf, nonce, pbuf[:n], ctr)
+			if err != nil {
+				return streamError("encrypt", ctr, off, err)
 			}
+			if err := writeChunk(w, hbuf, nonce, c); err != nil {
+				return streamError("encrypt", ctr, off, err)
+			}
+			ctr++
+			t.chunk(n, *t.cipher)
 		}
 
 		if readErr == io.EOF {
 			break
 		}
+		if readErr != nil {
+			return streamError("encrypt", ctr, off, readErr)
+		}
 	}
-	// write the tomb chunk header
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	return nil
+}
+
+// writeChunk writes a chunk header, encoded in `hbuf`, followed by the
+// encrypted chunk `c`
+func writeChunk(w io.Writer, hbuf []byte, nonce []byte, c []byte) error {
+	if len(c) == 0 {
+		return nil
+	}
+	// write a chunk header containing actual encrypted block size
+	if _, err := w.Write(appendChunkHeader(hbuf[:0], chunkHeader{nonce: nonce, size: uint32(len(c))})); err != nil {
 		return err
 	}
-	return writeChunkHeader(chunkHeader{nonce: nonce, size: 0, tomb: true}, w)
+	// write encrypted data to output steam
+	_, err := w.Write(c)
+	return err
 }
 
 // Decrypt reads chunks of data from `r` and writes the decrypted
 // chunks to `w` using the specified key. Reading continues until io.EOF.
-func Decrypt(r io.Reader, w io.Writer, skey string) error {
-	gcm, err := getGCM(skey)
-	if err != nil {
-		return err
+//
+// The stream header names the format the stream was written in, and the
+// matching registered decoder is used, so streams written by older versions
+// remain readable.
+//
+// That includes format 1.0, whose header does not commit to the key. A
+// service decrypting untrusted input with one of several keys must pass
+// WithKeyCommitment or WithoutDeprecated: otherwise 1.0 streams crafted to
+// open under many guessed keys at once let an attacker narrow its keys down
+// from which streams it accepts.
+func Decrypt(r io.Reader, w io.Writer, skey string, opts ...Option) error {
+	return DecryptContext(context.Background(), r, w, skey, opts...)
+}
+
+// DecryptContext is like Decrypt but stops early when `ctx` is done.
+//
+// The context is checked between chunks, so a blocked read or write is not
+// interrupted. When cancelled, the returned error wraps ctx.Err() and reports
+// the number of plaintext bytes written so far.
+func DecryptContext(ctx context.Context, r io.Reader, w io.Writer, skey string, opts ...Option) error {
+	key := passphraseKey(skey)
+	defer key.Destroy()
+	return DecryptWithKeyContext(ctx, r, w, key, opts...)
+}
+
+// DecryptWithKey is like Decrypt but takes the key as a Key, which can be
+// wiped from memory once done with. As with Decrypt, pass WithKeyCommitment
+// when trying several keys on untrusted input.
+func DecryptWithKey(r io.Reader, w io.Writer, key *Key, opts ...Option) error {
+	return DecryptWithKeyContext(context.Background(), r, w, key, opts...)
+}
+
+// DecryptWithKeyContext is like DecryptWithKey but stops early when `ctx` is
+// done, as DecryptContext does.
+func DecryptWithKeyContext(ctx context.Context, r io.Reader, w io.Writer, key *Key, opts ...Option) error {
+	_, _, err := decryptStream(ctx, r, w, key, newOptions(opts))
+	return err
+}
+
+// decryptStream decrypts `r` to `w`, or only authenticates it if `w` is nil.
+// It returns the header it read and the tracker counting what was processed.
+func decryptStream(ctx context.Context, r io.Reader, w io.Writer, key *Key, o *options) (*header, *tracker, error) {
+	cr := &countingReader{r: r}
+	t := newTracker(o, r, true, &cr.n)
+	if err := key.check(); err != nil {
+		return nil, t, streamError("decrypt", 0, 0, err)
 	}
 
-	maxChunkSize := chunkSize + gcm.Overhead()
-	maxChunkSizeSanity := maxChunkSize * 2
+	// read the binary stream out of armor
+	r, armored, err := dearmor(r)
+	if err != nil {
+		return nil, t, streamError("decrypt", 0, 0, err)
+	}
+	if armored {
+		if o.checkpoint != nil {
+			return nil, t, streamError("decrypt", 0, 0, errArmorCheckpoint)
+		}
+		if o.totalSize < 0 {
+			t.total = -1 // the size of the armor is not that of the stream
+		}
+	}
+	cr.r = r
 
-	// reuse buffers to reduce GC
-	buf := make([]byte, maxChunkSize)
-	var ctr uint32 = 1 // track expected chunk counter
+	// read and validate the header, then pick the decoder for its format
+	h := &header{}
+	if err := h.read(cr); err != nil {
+		return nil, t, streamError("decrypt", 0, 0, err)
+	}
+	dec, err := newStreamDecoder(h, key, o)
+	if err != nil {
+		return h, t, streamError("decrypt", 0, 0, err)
+	}
+	return h, t, decryptChunks(ctx, cr, w, dec, o, t, newCheckpointer(o, key, true, h))
+}
 
-	// read and validate the header
-	h := header{}
-	if err := h.read(r); err != nil {
+// decryptChunks decrypts the chunks of `r` after the stream header,
+// continuing from the chunk after those counted in `t`, up to the end of the
+// stream.
+func decryptChunks(ctx context.Context, r io.Reader, w io.Writer, dec decoder, o *options, t *tracker, ck *checkpointer) error {
+	var err error
+	if o.concurrency > 1 {
+		err = decryptParallel(ctx, r, w, dec, o, t, ck)
+	} else {
+		err = decryptSequential(ctx, r, w, dec, o.bufs, t, ck)
+	}
+	if err != nil {
 		return err
 	}
 
-	for {
-		// read next chunk header
-		var ch chunkHeader
-		ch, err = readChunkHeader(r, maxChunkSizeSanity)
-		if err != nil && !ch.tomb {
-			return err
+	// nothing may follow the tomb
+	if !o.allowTrailing {
+		off := *t.cipher
+		if err := checkTrailing(r); err != nil {
+			return streamError("decrypt", t.chunks+1, off, err)
 		}
-		if ch.tomb {
-			break // tomb chunk header means we're done
+	}
+	t.done()
+	return nil
+}
+
+// decryptSequential decrypts the chunks of `r` one at a time on the calling
+// goroutine. Plaintext is discarded if `w` is nil.
+func decryptSequential(ctx context.Context, r io.Reader, w io.Writer, dec decoder, bufs *bufferPool, t *tracker, ck *checkpointer) error {
+	maxChunkSize := chunkSize + dec.overhead()
+
+	// reuse buffers to reduce GC; they hold plaintext, so put clears the part
+	// that was used
+	buf := bufs.get(maxChunkSize)
+	used := 0
+	defer func() { bufs.put(buf[:used]) }()
+	hbuf := make([]byte, maxChunkHeaderSize)
+	ctr := t.chunks + 1 // track expected chunk counter
+
+	for {
+		off := *t.cipher
+		if err := ctx.Err(); err != nil {
+			return streamError("decrypt", ctr, off, cancelled("decrypt", t.plain, err))
 		}
-		// ensure cbuf is big enough
-		if cap(buf) < int(ch.size) {
-			buf = make([]byte, ch.size)
+		ch, cbuf, err := readChunk(r, hbuf, buf, maxChunkSize)
+		if err != nil {
+			return streamError("decrypt", ctr, off, err)
 		}
-		// read the encrypted chunk
-		cbuf := buf[:ch.size]
-		n, readErr := r.Read(cbuf)
-		if readErr != nil && readErr != io.EOF {
-			return readErr
+		if ch.tomb {
+			// tomb chunk header means we're done
+			return streamError("decrypt", ctr, off, dec.openTomb(cbuf, ch.nonce, ctr))
 		}
-		if n != int(ch.size) {
-			return fmt.Errorf("wrong chunk size read, expected %d, got %d", ch.size, n)
+		buf = cbuf[:cap(cbuf)]
+		used = max(used, len(cbuf))
+		pbuf, err := dec.open(cbuf, ch.nonce, ctr)
+		if err != nil {
+			return streamError("decrypt", ctr, off, err)
 		}
-		// decrypt the chunk with AAD verification
-		aad := make([]byte, 4)
-		binary.LittleEndian.PutUint32(aad, ctr)
 		ctr++
-		var pbuf []byte
-		if pbuf, err = gcm.Open(cbuf[:0], ch.nonce, cbuf, aad); err != nil {
-			return err
-		}
 		// write plaintext to w
-		if _, err := w.Write(pbuf); err != nil {
-			return err
+		if w != nil {
+			if _, err := w.Write(pbuf); err != nil {
+				return streamError("decrypt", ctr-1, off, err)
+			}
+		}
+		t.chunk(len(pbuf), *t.cipher)
+		if err := ck.save(ctr, *t.cipher, t.plain, nil); err != nil {
+			return streamError("decrypt", ctr, *t.cipher, err)
 		}
 	}
-	return nil
 }
 
-// getGCM returns a AES256 block cipher wrapped in GCM.
-func getGCM(skey string) (cipher.AEAD, error) {
+// readChunk reads the next chunk header into `hbuf`, as readChunkHeader does,
+// and the encrypted chunk that follows it into `buf`, growing `buf` if
+// needed. A buffer that is replaced is cleared first, since it may hold the
+// plaintext of the last chunk; callers keep the returned one. The tomb's
+// payload is read the same way; it is empty in formats that do not
+// authenticate the end of stream.
+func readChunk(r io.Reader, hbuf []byte, buf []byte, maxChunkSize int) (chunkHeader, []byte, error) {
+	// read next chunk header
+	ch, err := readChunkHeader(r, hbuf, maxChunkSize*2)
+	if err != nil {
+		return ch, nil, err
+	}
+	// ensure buf is big enough
+	if cap(buf) < int(ch.size) {
+		clear(buf[:cap(buf)])
+		buf = make([]byte, ch.size)
+	}
+	// read the encrypted chunk
+	cbuf := buf[:ch.size]
+	if _, err := io.ReadFull(r, cbuf); err != nil {
+		return ch, nil, truncated(err)
+	}
+	return ch, cbuf, nil
+}
+
+// fillChunk reads from `r` until `buf` is full or the input ends, so chunks
+// are full-sized however `r` delivers bytes. It returns io.EOF once the input
+// is exhausted.
+func fillChunk(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// checkTrailing returns ErrTrailingData unless `r` is at io.EOF
+func checkTrailing(r io.Reader) error {
+	var b [1]byte
+	n, err := io.ReadFull(r, b[:])
+	if n > 0 {
+		return ErrTrailingData
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// cancelled wraps a context error with the number of plaintext bytes processed
+func cancelled(op string, processed int64, err error) error {
+	return fmt.Errorf("%s cancelled after %d bytes: %w", op, processed, err)
+}
+
+// getGCM returns a AES256 block cipher wrapped in GCM, built once per Key.
+// The cipher is safe for concurrent use, so streams share it.
+func getGCM(k *Key) (cipher.AEAD, error) {
+	return cached(k, func(d *derivedKeys) *cipher.AEAD { return &d.v1 }, func() (cipher.AEAD, error) {
+		return newGCM(k)
+	})
+}
+
+// newGCM returns a new AES256 block cipher wrapped in GCM for the format 1.0
+// key of `k`
+func newGCM(k *Key) (cipher.AEAD, error) {
 	// key must be hashed to 32 bytes for AES256
-	key := sha512.Sum512_256([]byte(skey))
+	key := k.master()
+	defer clear(key[:])
 
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
@@ -153,10 +414,3 @@ func getGCM(skey string) (cipher.AEAD, error) {
 	}
 	return gcm, nil
 }
-
-// writes a file header
-func writeHeader(w io.Writer) error {
-	h := header{}
-	h.init()
-	return h.write(w)
-}
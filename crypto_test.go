@@ -2,9 +2,12 @@ package cryptod
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
 	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func TestEncryptDecrypt(t *testing.T) {
@@ -122,6 +125,56 @@ func TestTamper(t *testing.T) {
 	}
 }
 
+func TestAssociatedData(t *testing.T) {
+	const key = "this is a secret"
+	plaintext := generatePlainText(chunkSize*2 + 100)
+	tenantA := WithAssociatedData([]byte("tenant-a/backups/db.dump"))
+	tenantB := WithAssociatedData([]byte("tenant-b/backups/db.dump"))
+
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key, tenantA); err != nil {
+		t.Fatal("encrypt error: ", err)
+	}
+	data := buf.Bytes()
+	if bytes.Contains(data, []byte("tenant-a")) {
+		t.Error("associated data is stored in the stream")
+	}
+
+	for _, workers := range []int{1, 4} {
+		pbuf := &bytes.Buffer{}
+		if err := Decrypt(bytes.NewReader(data), pbuf, key, tenantA, WithConcurrency(workers)); err != nil {
+			t.Fatalf("workers=%d: decrypt error: %v", workers, err)
+		}
+		if !bytes.Equal(plaintext, pbuf.Bytes()) {
+			t.Errorf("workers=%d: plaintext mismatch", workers)
+		}
+
+		var se *StreamError
+		err := Decrypt(bytes.NewReader(data), io.Discard, key, tenantB, WithConcurrency(workers))
+		if !errors.Is(err, ErrAuthentication) || !errors.As(err, &se) || se.Chunk != 1 {
+			t.Errorf("workers=%d: other associated data: expected ErrAuthentication at chunk 1, got %v", workers, err)
+		}
+		if err := Decrypt(bytes.NewReader(data), io.Discard, key, WithConcurrency(workers)); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("workers=%d: missing associated data: expected ErrAuthentication, got %v", workers, err)
+		}
+	}
+
+	// empty associated data is the same as none
+	buf.Reset()
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key, WithAssociatedData([]byte{})); err != nil {
+		t.Fatal("encrypt error: ", err)
+	}
+	if err := Decrypt(buf, io.Discard, key); err != nil {
+		t.Errorf("empty associated data: decrypt error: %v", err)
+	}
+
+	// format 1.0 cannot authenticate it
+	err := Encrypt(bytes.NewReader(plaintext), io.Discard, key, tenantA, WithFormat(FormatV1))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("format 1.0: expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
 // TestChunkBoundaries tests encryption/decryption at exact chunk size boundaries
 func TestChunkBoundaries(t *testing.T) {
 	// Test data sizes that align exactly with chunk boundaries
@@ -219,6 +272,126 @@ func TestEmptyFile(t *testing.T) {
 	}
 }
 
+// TestShortReads verifies framing does not depend on how readers deliver bytes
+func TestShortReads(t *testing.T) {
+	const key = "secret key"
+	size := chunkSize*3 + 500
+	plaintext := generatePlainText(size)
+
+	readers := map[string]func(io.Reader) io.Reader{
+		"OneByteReader":     iotest.OneByteReader,
+		"HalfReader":        iotest.HalfReader,
+		"DataErrReader":     iotest.DataErrReader,
+		"HalfDataErrReader": func(r io.Reader) io.Reader { return iotest.DataErrReader(iotest.HalfReader(r)) },
+		"default reader":    func(r io.Reader) io.Reader { return r },
+	}
+
+	for name, wrap := range readers {
+		for _, workers := range []int{1, 3} {
+			buf := &bytes.Buffer{}
+			if err := Encrypt(wrap(bytes.NewReader(plaintext)), buf, key, WithConcurrency(workers)); err != nil {
+				t.Fatalf("%s (workers=%d): encrypt error: %v", name, workers, err)
+			}
+
+			// encryption always emits full chunks
+			chunks, _, _ := parseEncryptedStream(t, buf.Bytes())
+			if len(chunks) != 4 {
+				t.Errorf("%s (workers=%d): expected 4 chunks, got %d", name, workers, len(chunks))
+			}
+
+			pbuf := &bytes.Buffer{}
+			if err := Decrypt(wrap(bytes.NewReader(buf.Bytes())), pbuf, key, WithConcurrency(workers)); err != nil {
+				t.Fatalf("%s (workers=%d): decrypt error: %v", name, workers, err)
+			}
+			if !bytes.Equal(plaintext, pbuf.Bytes()) {
+				t.Errorf("%s (workers=%d): compare failed, bytes differ", name, workers)
+			}
+		}
+	}
+}
+
+// TestEncryptContextCancel verifies encryption stops between chunks once the context is cancelled
+func TestEncryptContextCancel(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize * 5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel as soon as the first chunk has been read
+	r := &cancelReader{r: bytes.NewReader(plaintext), cancel: cancel}
+	buf := &bytes.Buffer{}
+
+	err := EncryptContext(ctx, r, buf, key)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if r.reads != 1 {
+		t.Errorf("expected encryption to stop after 1 read, got %d", r.reads)
+	}
+}
+
+// TestDecryptContextCancel verifies decryption stops between chunks once the context is cancelled
+func TestDecryptContextCancel(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize * 5)
+
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel as soon as the first chunk of plaintext has been written
+	w := &cancelWriter{cancel: cancel}
+	err := DecryptContext(ctx, buf, w, key)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if w.n != chunkSize {
+		t.Errorf("expected %d bytes written before cancel, got %d", chunkSize, w.n)
+	}
+}
+
+// TestEncryptContextDone verifies an already cancelled context does no work
+func TestEncryptContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	buf := &bytes.Buffer{}
+	err := EncryptContext(ctx, bytes.NewReader(generatePlainText(100)), buf, "secret key")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// cancelReader cancels a context after the first read
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+	reads  int
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	c.reads++
+	c.cancel()
+	return c.r.Read(p)
+}
+
+// cancelWriter cancels a context after the first write
+type cancelWriter struct {
+	cancel context.CancelFunc
+	n      int
+}
+
+func (c *cancelWriter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	c.cancel()
+	return len(p), nil
+}
+
 // helper to generate predicable plaintext of any size
 func generatePlainText(size int) []byte {
 	const s = "0123456789"
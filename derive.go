@@ -0,0 +1,55 @@
+package cryptod
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"path"
+	"path/filepath"
+)
+
+// DeriveKey returns the raw key for `purpose`, such as "backups" or "logs",
+// and the optional `context` strings, such as a tenant and a file name,
+// derived from `master` with HKDF-SHA256. Each distinct purpose and context
+// gives an independent key, and knowing a derived key reveals nothing about
+// `master` or the other keys derived from it.
+//
+// Every string is length-prefixed before it is hashed, so the derivation is
+// unambiguous: DeriveKey(m, "p", "ab", "c") and DeriveKey(m, "p", "a", "bc")
+// are unrelated, unlike keys built by concatenating a secret and a name.
+func DeriveKey(master *Key, purpose string, context ...string) (*Key, error) {
+	if err := master.check(); err != nil {
+		return nil, err
+	}
+	if purpose == "" {
+		return nil, errors.New("key purpose must not be empty")
+	}
+	info := binary.AppendUvarint([]byte("cryptod derive key"), uint64(len(purpose)))
+	info = append(info, purpose...)
+	for _, c := range context {
+		info = binary.AppendUvarint(info, uint64(len(c)))
+		info = append(info, c...)
+	}
+
+	m := master.master()
+	defer clear(m[:])
+	b, err := hkdf.Key(sha256.New, m[:], nil, string(info), RawKeySize)
+	if err != nil {
+		return nil, err
+	}
+	return newKey(b, true), nil
+}
+
+// KeyForPath returns the key for the file at `name`, derived from `master`
+// with DeriveKey. The path is first cleaned and its separators made forward
+// slashes, so "a/b", "a//b", "./a/b" and, on Windows, `a\b` all give the
+// same key. Nothing else is normalised: relative and absolute paths to one
+// file give different keys, as do paths differing in case or in Unicode
+// normal form, so derive from a path relative to a fixed root.
+func KeyForPath(master *Key, name string) (*Key, error) {
+	if name == "" {
+		return nil, errors.New("empty path")
+	}
+	return DeriveKey(master, "file path", path.Clean(filepath.ToSlash(name)))
+}
@@ -0,0 +1,100 @@
+package cryptod
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	master := NewKey([]byte("master secret"))
+	derive := func(purpose string, context ...string) []byte {
+		k, err := DeriveKey(master, purpose, context...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !k.raw || len(k.b) != RawKeySize {
+			t.Fatalf("derived key is not a raw key")
+		}
+		return k.b
+	}
+
+	// pinned, so the derivation never changes by accident
+	want, _ := hex.DecodeString("61018b22d52710966dc34e564d64ce4d6aa3942f96534e5ae4c9a295c6ab19ad")
+	if got := derive("test", "a", "b"); !bytes.Equal(got, want) {
+		t.Errorf("unexpected derived key %x", got)
+	}
+
+	seen := make(map[string][]string)
+	for _, args := range [][]string{
+		{"test", "a", "b"},
+		{"test", "ab"},
+		{"test", "a", "bc"},
+		{"test", "ab", "c"},
+		{"test", "a", "b", ""},
+		{"test"},
+		{"test", ""},
+		{"testa", "b"},
+		{"other", "a", "b"},
+	} {
+		k := string(derive(args[0], args[1:]...))
+		if prev, ok := seen[k]; ok {
+			t.Errorf("%q and %q derive the same key", prev, args)
+		}
+		seen[k] = args
+	}
+
+	if _, err := DeriveKey(master, ""); err == nil {
+		t.Error("expected an error for an empty purpose")
+	}
+	if _, err := DeriveKey(NewKey([]byte("master secret")), "test", "a", "b"); err != nil {
+		t.Error(err)
+	}
+	master.Destroy()
+	if _, err := DeriveKey(master, "test"); !errors.Is(err, ErrKeyDestroyed) {
+		t.Errorf("expected ErrKeyDestroyed, got %v", err)
+	}
+}
+
+func TestKeyForPath(t *testing.T) {
+	master := NewKey([]byte("master secret"))
+	keyFor := func(name string) string {
+		k, err := KeyForPath(master, name)
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		return string(k.b)
+	}
+
+	base := keyFor("docs/report.txt")
+	for _, name := range []string{"docs//report.txt", "./docs/report.txt", "docs/old/../report.txt", "docs/./report.txt"} {
+		if keyFor(name) != base {
+			t.Errorf("%q derives a different key from docs/report.txt", name)
+		}
+	}
+	for _, name := range []string{"/docs/report.txt", "docs/Report.txt", "docs/report.txt.bak", "report.txt"} {
+		if keyFor(name) == base {
+			t.Errorf("%q derives the same key as docs/report.txt", name)
+		}
+	}
+	if _, err := KeyForPath(master, ""); err == nil {
+		t.Error("expected an error for an empty path")
+	}
+
+	// derived keys encrypt like any raw key
+	k, _ := KeyForPath(master, "docs/report.txt")
+	plaintext := generatePlainText(1000)
+	buf := &bytes.Buffer{}
+	if err := EncryptWithKey(bytes.NewReader(plaintext), buf, k); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := KeyForPath(master, "docs/other.txt")
+	if err := DecryptWithKey(bytes.NewReader(buf.Bytes()), &bytes.Buffer{}, other); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("another path's key: expected ErrAuthentication, got %v", err)
+	}
+	out := &bytes.Buffer{}
+	if err := DecryptWithKey(buf, out, k); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+		t.Errorf("decrypt error: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package cryptod
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Encryptor encrypts streams with one key and one set of options. Build it
+// once and reuse it when encrypting many streams, e.g. small payloads in a
+// service: the options are parsed once, the 2MB of chunk buffers each
+// stream needs are recycled rather than allocated and collected every time,
+// and what depends on the key alone, the master key, the chunking table and
+// the format 1.0 cipher, is derived by NewEncryptor and kept with the Key.
+// Each stream still derives its own AES key from the random salt in its
+// header, which is what keeps streams independent, so that key schedule is
+// built per stream; it costs far less than the buffers. What an Encryptor
+// saves is bytes: a stream makes about as many allocations either way, as
+// its header, key derivation and cipher are set up anew each time.
+//
+// An Encryptor is safe for concurrent use. Its key must not be destroyed
+// while it is in use.
+type Encryptor struct {
+	key *Key
+	o   *options
+}
+
+// NewEncryptor returns an Encryptor for `key` that applies `opts` to every
+// stream, as Encrypt does.
+func NewEncryptor(key *Key, opts ...Option) (*Encryptor, error) {
+	if err := key.check(); err != nil {
+		return nil, err
+	}
+	o := newOptions(opts)
+	o.bufs = &bufferPool{}
+	if err := deriveKeys(key, o); err != nil {
+		return nil, err
+	}
+	return &Encryptor{key: key, o: o}, nil
+}
+
+// Encrypt encrypts `r` to `w` as Encrypt does.
+func (e *Encryptor) Encrypt(r io.Reader, w io.Writer) error {
+	_, err := encryptStream(context.Background(), r, w, e.key, e.o)
+	return err
+}
+
+// EncryptContext is like Encrypt but stops early when `ctx` is done, as
+// EncryptContext does.
+func (e *Encryptor) EncryptContext(ctx context.Context, r io.Reader, w io.Writer) error {
+	_, err := encryptStream(ctx, r, w, e.key, e.o)
+	return err
+}
+
+// Decryptor decrypts streams with one key and one set of options, recycling
+// buffers and derived keys between them like an Encryptor. It is safe for
+// concurrent use.
+type Decryptor struct {
+	key *Key
+	o   *options
+}
+
+// NewDecryptor returns a Decryptor for `key` that applies `opts` to every
+// stream, as Decrypt does.
+func NewDecryptor(key *Key, opts ...Option) (*Decryptor, error) {
+	if err := key.check(); err != nil {
+		return nil, err
+	}
+	o := newOptions(opts)
+	o.bufs = &bufferPool{}
+	if err := deriveKeys(key, o); err != nil {
+		return nil, err
+	}
+	return &Decryptor{key: key, o: o}, nil
+}
+
+// Decrypt decrypts `r` to `w` as Decrypt does.
+func (d *Decryptor) Decrypt(r io.Reader, w io.Writer) error {
+	_, _, err := decryptStream(context.Background(), r, w, d.key, d.o)
+	return err
+}
+
+// DecryptContext is like Decrypt but stops early when `ctx` is done, as
+// DecryptContext does.
+func (d *Decryptor) DecryptContext(ctx context.Context, r io.Reader, w io.Writer) error {
+	_, _, err := decryptStream(ctx, r, w, d.key, d.o)
+	return err
+}
+
+// deriveKeys fills the cache of `key` with what streams using `o` derive
+// from it, so that the first stream does not pay for it
+func deriveKeys(key *Key, o *options) error {
+	master := key.master()
+	clear(master[:])
+	if o.chunking != nil {
+		if _, err := gearTable(key); err != nil {
+			return err
+		}
+	}
+	if o.format == FormatV1 && !key.raw {
+		if _, err := getGCM(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// poolBufferSize is the capacity of pooled buffers: a full chunk and its tag
+const poolBufferSize = chunkSize + 64
+
+// bufferPool recycles chunk buffers between streams. A nil *bufferPool
+// allocates every buffer. Buffers held plaintext, so they are cleared when
+// put back, whether or not they are kept, and pooled buffers are all zeros.
+type bufferPool struct {
+	p sync.Pool // of *[]byte with capacity poolBufferSize
+}
+
+// get returns a buffer of length `n`
+func (bp *bufferPool) get(n int) []byte {
+	if bp == nil || n > poolBufferSize {
+		return make([]byte, n)
+	}
+	if b, ok := bp.p.Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, poolBufferSize)
+}
+
+// put clears `b`, which must cover every byte written since get, and returns
+// its array to the pool
+func (bp *bufferPool) put(b []byte) {
+	clear(b)
+	if bp != nil && cap(b) == poolBufferSize {
+		b = b[:0]
+		bp.p.Put(&b)
+	}
+}
@@ -0,0 +1,109 @@
+package cryptod
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Sentinel errors returned (wrapped) by Encrypt and Decrypt. Test for them
+// with errors.Is.
+var (
+	// ErrBadHeader means the stream does not start with a valid cryptod header.
+	ErrBadHeader = errors.New("cryptod: invalid stream header")
+
+	// ErrUnsupportedVersion means the header names an encryption scheme or
+	// format version this package cannot decrypt.
+	ErrUnsupportedVersion = errors.New("cryptod: unsupported format version")
+
+	// ErrDeprecatedFormat means a stream uses a format marked deprecated while
+	// the WithoutDeprecated policy is in effect. It also matches
+	// ErrUnsupportedVersion.
+	ErrDeprecatedFormat = fmt.Errorf("%w: format is deprecated", ErrUnsupportedVersion)
+
+	// ErrBadChunk means a chunk header is malformed, e.g. its tags or sizes
+	// are invalid.
+	ErrBadChunk = errors.New("cryptod: malformed chunk header")
+
+	// ErrAuthentication means a chunk failed authentication: the key is wrong,
+	// or the data was corrupted or tampered with.
+	ErrAuthentication = errors.New("cryptod: message authentication failed")
+
+	// ErrWrongKey means the stream header shows it was encrypted with another
+	// key, so no chunk was processed. It also matches ErrAuthentication.
+	// Format 1.0 streams record nothing about their key, so a wrong key is
+	// only found by the first chunk failing with ErrAuthentication.
+	ErrWrongKey = fmt.Errorf("%w: wrong key", ErrAuthentication)
+
+	// ErrTruncated means the stream ended before its end of stream marker.
+	ErrTruncated = errors.New("cryptod: stream truncated")
+
+	// ErrTrailingData means there is more data after the end of stream marker.
+	ErrTrailingData = errors.New("cryptod: trailing data after end of stream")
+
+	// ErrCounterExhausted means a stream reached the largest chunk counter its
+	// format allows. Encryption stops rather than reuse a counter.
+	ErrCounterExhausted = errors.New("cryptod: chunk counter exhausted")
+
+	// ErrBadCheckpoint means a checkpoint is corrupt, was made with another
+	// key, or no longer matches the input or output it is resumed with.
+	ErrBadCheckpoint = errors.New("cryptod: invalid checkpoint")
+
+	// ErrRepository means a directory opened as a Repository has no config
+	// but is not empty, or is laid out in an unknown version.
+	ErrRepository = errors.New("cryptod: invalid repository")
+
+	// ErrInvalidKey means a raw key has the wrong size, or encoded key
+	// text is malformed or fails its checksum.
+	ErrInvalidKey = errors.New("cryptod: invalid key")
+
+	// ErrBadArmor means armored input is malformed, e.g. its BEGIN line is
+	// wrong or it holds invalid base64.
+	ErrBadArmor = errors.New("cryptod: malformed armor")
+
+	// ErrKeyDestroyed means a Key was used after Destroy.
+	ErrKeyDestroyed = errors.New("cryptod: key destroyed")
+
+	// ErrStreamClosed means a Writer or Reader was used after Close.
+	ErrStreamClosed = errors.New("cryptod: stream is closed")
+)
+
+// StreamError records where in a stream an operation failed. It wraps the
+// underlying error, which is often one of the sentinel errors above.
+type StreamError struct {
+	Op     string // "encrypt", "decrypt", "verify", "recover" or "inspect"
+	Chunk  uint64 // 1-based index of the chunk being processed, 0 for the stream header
+	Offset int64  // offset in the encrypted stream of the start of the failing header or chunk
+	Err    error
+}
+
+func (e *StreamError) Error() string {
+	if e.Chunk == 0 {
+		return fmt.Sprintf("%s: header at offset %d: %v", e.Op, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("%s: chunk %d at offset %d: %v", e.Op, e.Chunk, e.Offset, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// streamError wraps `err` with its location, unless it is nil or already located
+func streamError(op string, chunk uint64, offset int64, err error) error {
+	if err == nil {
+		return nil
+	}
+	var se *StreamError
+	if errors.As(err, &se) {
+		return err
+	}
+	return &StreamError{Op: op, Chunk: chunk, Offset: offset, Err: err}
+}
+
+// truncated maps an unexpected end of input to ErrTruncated
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %v", ErrTruncated, err)
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestErrors(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize*2 + 100)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	good := buf.Bytes()
+	chunks, header, tomb := parseEncryptedStream(t, good)
+
+	// offset of the start of the n'th chunk (1-based)
+	chunkOffset := func(n int) int64 {
+		off := len(header)
+		for _, c := range chunks[:n-1] {
+			off += len(c)
+		}
+		return int64(off)
+	}
+
+	modify := func(f func(b []byte) []byte) []byte {
+		b := append([]byte(nil), good...)
+		return f(b)
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		key    string
+		want   error
+		chunk  uint64
+		offset int64
+	}{
+		{"bad magic", modify(func(b []byte) []byte { b[1] = 'x'; return b }), key, ErrBadHeader, 0, 0},
+		{"bad header size", modify(func(b []byte) []byte { b[0]++; return b }), key, ErrBadHeader, 0, 0},
+		{"unsupported scheme", modify(func(b []byte) []byte { b[3] = 'x'; return b }), key, ErrUnsupportedVersion, 0, 0},
+		{"unsupported version", modify(func(b []byte) []byte { b[12] = 9; return b }), key, ErrUnsupportedVersion, 0, 0},
+		{"short header", good[:5], key, ErrTruncated, 0, 0},
+		{"wrong key", good, "wrong key", ErrWrongKey, 0, 0},
+		{"tampered chunk", modify(func(b []byte) []byte { b[chunkOffset(2)+40]++; return b }), key, ErrAuthentication, 2, chunkOffset(2)},
+		{"bad chunk tag", modify(func(b []byte) []byte { b[chunkOffset(2)] = 'x'; return b }), key, ErrBadChunk, 2, chunkOffset(2)},
+		{"truncated chunk", good[:chunkOffset(2)+100], key, ErrTruncated, 2, chunkOffset(2)},
+		{"missing tomb", good[:len(good)-len(tomb)], key, ErrTruncated, 4, int64(len(good) - len(tomb))},
+		{"truncated tomb", good[:len(good)-1], key, ErrTruncated, 4, int64(len(good) - len(tomb))},
+		{"trailing data", append(append([]byte(nil), good...), 0), key, ErrTrailingData, 4, int64(len(good))},
+	}
+
+	for _, tt := range tests {
+		for _, workers := range []int{1, 4} {
+			err := Decrypt(bytes.NewReader(tt.data), io.Discard, tt.key, WithConcurrency(workers))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s (workers=%d): expected %v, got %v", tt.name, workers, tt.want, err)
+				continue
+			}
+			if tt.want != ErrWrongKey && errors.Is(err, ErrWrongKey) {
+				t.Errorf("%s (workers=%d): reported as a wrong key: %v", tt.name, workers, err)
+			}
+			var se *StreamError
+			if !errors.As(err, &se) {
+				t.Errorf("%s (workers=%d): expected a *StreamError, got %T", tt.name, workers, err)
+				continue
+			}
+			if se.Op != "decrypt" || se.Chunk != tt.chunk || se.Offset != tt.offset {
+				t.Errorf("%s (workers=%d): expected decrypt chunk %d at offset %d, got %s chunk %d at offset %d",
+					tt.name, workers, tt.chunk, tt.offset, se.Op, se.Chunk, se.Offset)
+			}
+		}
+	}
+}
+
+func TestTrailingDataAllowed(t *testing.T) {
+	const key = "secret key"
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(generatePlainText(1000)), buf, key); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	buf.WriteString("more data")
+
+	pbuf := &bytes.Buffer{}
+	if err := Decrypt(buf, pbuf, key, WithTrailingData()); err != nil {
+		t.Fatalf("decrypt error: %v", err)
+	}
+	if buf.String() != "more data" {
+		t.Errorf("expected trailing data to be left unread, got %q", buf.String())
+	}
+}
+
+func TestEncryptStreamError(t *testing.T) {
+	errRead := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader(generatePlainText(chunkSize)), iotest.ErrReader(errRead))
+
+	for _, workers := range []int{1, 4} {
+		buf := &bytes.Buffer{}
+		err := Encrypt(r, buf, "secret key", WithConcurrency(workers))
+		var se *StreamError
+		if !errors.As(err, &se) || !errors.Is(err, errRead) {
+			t.Fatalf("workers=%d: expected a *StreamError wrapping the read error, got %v", workers, err)
+		}
+		if se.Op != "encrypt" || se.Chunk != 2 || se.Offset != int64(buf.Len()) {
+			t.Errorf("workers=%d: expected encrypt chunk 2 at offset %d, got %s chunk %d at offset %d",
+				workers, buf.Len(), se.Op, se.Chunk, se.Offset)
+		}
+		r = io.MultiReader(bytes.NewReader(generatePlainText(chunkSize)), iotest.ErrReader(errRead))
+	}
+}
@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package main_test
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArmor(t *testing.T) {
+	dir := t.TempDir()
+	crypt := buildCrypt(t, dir)
+
+	plain := generatePlainText(1024*1000 + 10)
+	fPlain := filepath.Join(dir, "config.yaml")
+	fEnc := filepath.Join(dir, "config.yaml.aes")
+	if err := os.WriteFile(fPlain, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCrypt(t, crypt, key, "-e", "-a", "-in="+fPlain); code != 0 {
+		t.Fatalf("encrypt failed with exit code %d", code)
+	}
+	enc, err := os.ReadFile(fEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(enc, []byte("-----BEGIN CRYPTOD ENCRYPTED STREAM-----\n")) ||
+		!bytes.HasSuffix(enc, []byte("-----END CRYPTOD ENCRYPTED STREAM-----\n")) {
+		t.Fatalf("output is not armored: %.100s", enc)
+	}
+
+	// decrypting detects the armor
+	fOut := filepath.Join(dir, "config.out")
+	if code := runCrypt(t, crypt, key, "-d", "-in="+fEnc, "-out="+fOut); code != 0 {
+		t.Fatalf("decrypt failed with exit code %d", code)
+	}
+	if got, err := os.ReadFile(fOut); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("output does not match the input: %v", err)
+	}
+	out, err := exec.Command(crypt, "inspect", fEnc).Output()
+	if err != nil || !strings.Contains(string(out), "ASCII armor") {
+		t.Errorf("inspect does not report the armor: %v\n%s", err, out)
+	}
+
+	// a damaged line
+	bad := bytes.Replace(enc, []byte("\n"), []byte("\n*"), 2)
+	fBad := filepath.Join(dir, "bad.aes")
+	if err := os.WriteFile(fBad, bad, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCrypt(t, crypt, key, "-d", "-in="+fBad, "-out="+filepath.Join(dir, "bad.out")); code != 10 {
+		t.Errorf("damaged armor: expected exit code 10, got %d", code)
+	}
+
+	if code := runCrypt(t, crypt, key, "-e", "-a", "-resume", "-in="+fPlain, "-out="+filepath.Join(dir, "resumed.aes")); code != 2 {
+		t.Errorf("-a with -resume: expected exit code 2, got %d", code)
+	}
+}
@@ -7,8 +7,13 @@ import (
 	"github.com/wiggin77/cryptod"
 )
 
-// cmd encrypts or decrypts a file
-func cmd(encrypt bool, fileIn string, fileOut string, skey string) error {
+// save a checkpoint every this many chunks when resumable
+const checkpointInterval = 16
+
+// cmd encrypts or decrypts a file. When `resumable`, checkpoints are saved
+// next to the output so an interrupted run can be resumed, and a run is
+// resumed if a checkpoint exists.
+func cmd(encrypt bool, fileIn string, fileOut string, key *cryptod.Key, resumable bool, opts ...cryptod.Option) error {
 
 	r, err := os.Open(fileIn)
 	if err != nil {
@@ -27,8 +32,19 @@ func cmd(encrypt bool, fileIn string, fileOut string, skey string) error {
 	}
 	fmode := fi.Mode()
 
-	// create output file, overwriting if it exists
-	w, err := os.Create(fileOut)
+	var cp *cryptod.Checkpoint
+	if resumable {
+		if cp, err = loadCheckpoint(checkpointFile(fileOut)); err != nil {
+			return err
+		}
+	}
+
+	// create output file, overwriting if it exists, unless resuming
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if cp != nil {
+		flags = os.O_RDWR
+	}
+	w, err := os.OpenFile(fileOut, flags, 0600)
 	if err != nil {
 		return err
 	}
@@ -43,12 +59,25 @@ func cmd(encrypt bool, fileIn string, fileOut string, skey string) error {
 		return err
 	}
 
-	if encrypt {
-		err = cryptod.Encrypt(r, w, skey)
-	} else {
-		err = cryptod.Decrypt(r, w, skey)
+	if resumable {
+		opts = append(opts, cryptod.WithCheckpoint(checkpointSaver(w, checkpointFile(fileOut))))
+	}
+
+	switch {
+	case cp != nil && encrypt:
+		err = cryptod.ResumeEncryptWithKey(r, w, key, cp, opts...)
+	case cp != nil:
+		err = cryptod.ResumeDecryptWithKey(r, w, key, cp, opts...)
+	case encrypt:
+		err = cryptod.EncryptWithKey(r, w, key, opts...)
+	default:
+		err = cryptod.DecryptWithKey(r, w, key, opts...)
 	}
 
+	if err != nil && resumable {
+		// keep the output and checkpoint to resume from
+		return err
+	}
 	if err != nil {
 		if closeErr := w.Close(); closeErr != nil {
 			fmt.Fprintf(os.Stderr, "warning: error closing output file during cleanup: %v\n", closeErr)
@@ -56,6 +85,56 @@ func cmd(encrypt bool, fileIn string, fileOut string, skey string) error {
 		if removeErr := os.Remove(fileOut); removeErr != nil {
 			fmt.Fprintf(os.Stderr, "warning: error removing output file during cleanup: %v\n", removeErr)
 		}
+		return err
+	}
+	if resumable {
+		if removeErr := os.Remove(checkpointFile(fileOut)); removeErr != nil && !os.IsNotExist(removeErr) {
+			fmt.Fprintf(os.Stderr, "warning: error removing checkpoint file: %v\n", removeErr)
+		}
+	}
+	return nil
+}
+
+// checkpointFile returns the name of the checkpoint file for output `fileOut`
+func checkpointFile(fileOut string) string {
+	return fileOut + ".checkpoint"
+}
+
+// loadCheckpoint reads the checkpoint in `name`, or returns nil if there is none
+func loadCheckpoint(name string) (*cryptod.Checkpoint, error) {
+	b, err := os.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &cryptod.Checkpoint{}
+	if err := cp.UnmarshalBinary(b); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return cp, nil
+}
+
+// checkpointSaver returns a checkpoint hook that periodically flushes `w`
+// and then atomically replaces the checkpoint file `name`
+func checkpointSaver(w *os.File, name string) func(*cryptod.Checkpoint) error {
+	return func(cp *cryptod.Checkpoint) error {
+		if cp.Chunk%checkpointInterval != 0 {
+			return nil
+		}
+		// the checkpoint must never claim output that is not on disk
+		if err := w.Sync(); err != nil {
+			return err
+		}
+		b, err := cp.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		tmp := name + ".tmp"
+		if err := os.WriteFile(tmp, b, 0600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, name)
 	}
-	return err
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/wiggin77/cryptod"
+)
+
+// keyDerivation holds the -derive, -root and -keyid flags, which the main
+// command, verify and recover share. With -derive, each file is encrypted with
+// a key derived from CRYPTOD_KEY and the path of its plaintext relative to
+// -root, or from -keyid when given, so files with the same name in different
+// directories get different keys.
+type keyDerivation struct {
+	derive bool
+	root   string
+	keyID  string
+}
+
+// register defines the flags on `fs`
+func (kd *keyDerivation) register(fs *flag.FlagSet) {
+	fs.BoolVar(&kd.derive, "derive", false, "use a key derived from CRYPTOD_KEY and the plaintext path relative to -root")
+	fs.StringVar(&kd.root, "root", ".", "with -derive, the directory plaintext paths are taken relative to")
+	fs.StringVar(&kd.keyID, "keyid", "", "with -derive, derive the key from this identifier instead of the path")
+}
+
+// check returns an error if the flags are inconsistent
+func (kd *keyDerivation) check() error {
+	if kd.keyID != "" && !kd.derive {
+		return errors.New("-keyid needs -derive")
+	}
+	return nil
+}
+
+// key returns the key for the file whose plaintext is at `plain`, or for
+// the encrypted file at `plain` if `encrypted`. The plaintext path of an
+// encrypted file is its path without the .aes suffix, whatever the output is
+// named, so that decrypting to another name or place needs the same key.
+func (kd *keyDerivation) key(skey string, plain string, encrypted bool) (*cryptod.Key, error) {
+	b := []byte(skey)
+	defer clear(b)
+	master := cryptod.NewKey(b)
+	if !kd.derive {
+		return master, nil
+	}
+	defer master.Destroy()
+	id := kd.keyID
+	if id == "" {
+		var err error
+		if id, err = kd.pathID(plain, encrypted); err != nil {
+			return nil, err
+		}
+	}
+	return cryptod.KeyForPath(master, id)
+}
+
+// pathID returns the path of the plaintext of `name` relative to the root
+func (kd *keyDerivation) pathID(name string, encrypted bool) (string, error) {
+	if encrypted {
+		if !strings.HasSuffix(name, ".aes") {
+			return "", fmt.Errorf("cannot tell the plaintext path of %s without a .aes suffix; use -keyid", name)
+		}
+		name = strings.TrimSuffix(name, ".aes")
+	}
+	root, err := filepath.Abs(expandTilde(kd.root))
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside -root %s", name, kd.root)
+	}
+	return rel, nil
+}
+
+// keyHint returns advice to print after a wrong key error
+func (kd *keyDerivation) keyHint() string {
+	if kd.derive {
+		return "hint: with -derive, the key depends on -root and the file path, or on -keyid, as when it was encrypted"
+	}
+	return "hint: if the file was encrypted with -derive, decrypt it with -derive too"
+}
@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package main_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wiggin77/cryptod"
+)
+
+func TestDeriveKey(t *testing.T) {
+	dir := t.TempDir()
+	crypt := buildCrypt(t, dir)
+
+	// two files with the same name in different directories under the root
+	root := filepath.Join(dir, "docs")
+	plain := generatePlainText(1024*1000 + 10)
+	for _, sub := range []string{"a", "b"} {
+		if err := os.MkdirAll(filepath.Join(root, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+		f := filepath.Join(root, sub, "report.txt")
+		if err := os.WriteFile(f, plain, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if code := runCrypt(t, crypt, key, "-e", "-derive", "-root="+root, "-in="+f); code != 0 {
+			t.Fatalf("encrypt %s failed with exit code %d", sub, code)
+		}
+	}
+	fEnc := filepath.Join(root, "a", "report.txt.aes")
+
+	// the file key is derived from the master key and the path under the root
+	master := cryptod.NewKey([]byte(key))
+	fileKey, err := cryptod.KeyForPath(master, "a/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sub, want := range map[string]bool{"a": true, "b": false} {
+		enc, err := os.ReadFile(filepath.Join(root, sub, "report.txt.aes"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		err = cryptod.DecryptWithKey(bytes.NewReader(enc), out, fileKey)
+		if got := err == nil && bytes.Equal(out.Bytes(), plain); got != want {
+			t.Errorf("%s/report.txt: decrypts with the key of a/report.txt: %v, want %v", sub, got, want)
+		}
+	}
+
+	// the master key alone, or another root, does not decrypt it
+	if code := runCrypt(t, crypt, key, "-d", "-in="+fEnc, "-out="+filepath.Join(dir, "plain.out")); code != 5 {
+		t.Errorf("decrypt without -derive: expected exit code 5, got %d", code)
+	}
+	if code := runCrypt(t, crypt, key, "-d", "-derive", "-root="+dir, "-in="+fEnc, "-out="+filepath.Join(dir, "plain.out")); code != 5 {
+		t.Errorf("decrypt under another root: expected exit code 5, got %d", code)
+	}
+
+	// the key does not depend on where the output goes
+	fOut := filepath.Join(dir, "restored.txt")
+	if code := runCrypt(t, crypt, key, "-d", "-derive", "-root="+root, "-in="+fEnc, "-out="+fOut); code != 0 {
+		t.Fatalf("decrypt failed with exit code %d", code)
+	}
+	if got, err := os.ReadFile(fOut); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("output does not match the input: %v", err)
+	}
+
+	// a moved file is decrypted by naming its original path with -keyid
+	moved := filepath.Join(dir, "moved.aes")
+	enc, _ := os.ReadFile(fEnc)
+	if err := os.WriteFile(moved, enc, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCrypt(t, crypt, key, "-d", "-derive", "-root="+dir, "-in="+moved, "-out="+filepath.Join(dir, "moved.out")); code != 5 {
+		t.Errorf("decrypt moved file: expected exit code 5, got %d", code)
+	}
+	if code := runCrypt(t, crypt, key, "-d", "-derive", "-keyid=a/report.txt", "-in="+moved, "-out="+filepath.Join(dir, "moved.txt")); code != 0 {
+		t.Errorf("decrypt moved file with -keyid: expected exit code 0, got %d", code)
+	}
+
+	// verify and recover derive keys the same way
+	encs := []string{fEnc, filepath.Join(root, "b", "report.txt.aes")}
+	if code := runCrypt(t, crypt, key, append([]string{"verify", "-derive", "-root=" + root}, encs...)...); code != 0 {
+		t.Errorf("verify -derive: expected exit code 0, got %d", code)
+	}
+	if code := runCrypt(t, crypt, key, append([]string{"verify"}, encs...)...); code != 5 {
+		t.Errorf("verify without -derive: expected exit code 5, got %d", code)
+	}
+	fRec := filepath.Join(dir, "recovered.txt")
+	if code := runCrypt(t, crypt, key, "recover", "-derive", "-root="+root, "-in="+fEnc, "-out="+fRec); code != 0 {
+		t.Errorf("recover -derive: expected exit code 0, got %d", code)
+	}
+	if got, err := os.ReadFile(fRec); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("recovered output does not match the input: %v", err)
+	}
+
+	// usage errors
+	outside := filepath.Join(dir, "outside.txt")
+	if err := os.WriteFile(outside, plain[:10], 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, args := range map[string][]string{
+		"outside the root":      {"-e", "-derive", "-root=" + root, "-in=" + outside},
+		"-keyid without derive": {"-e", "-keyid=x", "-in=" + outside, "-f"},
+		"no .aes suffix":        {"-d", "-derive", "-root=" + dir, "-in=" + outside, "-out=" + outside + ".out"},
+		"verify -keyid alone":   {"verify", "-keyid=x", fEnc},
+	} {
+		if code := runCrypt(t, crypt, key, args...); code != 2 {
+			t.Errorf("%s: expected exit code 2, got %d", name, code)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/wiggin77/cryptod"
+)
+
+// exit codes, so scripts can tell failure modes apart
+const (
+	exitOK                 = 0
+	exitError              = 1  // any other error, e.g. I/O
+	exitUsage              = 2  // invalid flags or arguments
+	exitBadHeader          = 3  // input is not a cryptod stream
+	exitUnsupportedVersion = 4  // unknown scheme or format version
+	exitAuthentication     = 5  // wrong key, or data corrupted or tampered with
+	exitTruncated          = 6  // input ends before the end of stream marker
+	exitTrailingData       = 7  // data follows the end of stream marker
+	exitBadChunk           = 8  // malformed chunk framing
+	exitDataLost           = 9  // recover could not salvage everything
+	exitBadArmor           = 10 // malformed ASCII armor
+)
+
+// errorText returns the message printed for `err`, which names a wrong key
+// plainly so it is not mistaken for corruption
+func errorText(err error) string {
+	if errors.Is(err, cryptod.ErrWrongKey) {
+		return "wrong key: the file was encrypted with a different key"
+	}
+	return err.Error()
+}
+
+// exitCode maps an error returned by cryptod to a process exit code
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, cryptod.ErrBadHeader):
+		return exitBadHeader
+	case errors.Is(err, cryptod.ErrUnsupportedVersion):
+		return exitUnsupportedVersion
+	case errors.Is(err, cryptod.ErrAuthentication):
+		return exitAuthentication
+	case errors.Is(err, cryptod.ErrTruncated):
+		return exitTruncated
+	case errors.Is(err, cryptod.ErrTrailingData):
+		return exitTrailingData
+	case errors.Is(err, cryptod.ErrBadChunk):
+		return exitBadChunk
+	case errors.Is(err, cryptod.ErrBadArmor):
+		return exitBadArmor
+	}
+	return exitError
+}
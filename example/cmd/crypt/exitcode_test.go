@@ -0,0 +1,112 @@
+//go:build linux
+// +build linux
+
+package main_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	crypt := buildCrypt(t, dir)
+
+	fPlain := filepath.Join(dir, "plain.txt")
+	fEnc := filepath.Join(dir, "plain.txt.aes")
+	if err := os.WriteFile(fPlain, generatePlainText(1024*1000*2), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCrypt(t, crypt, key, "-e", "-in="+fPlain, "-out="+fEnc); code != 0 {
+		t.Fatalf("encrypt failed with exit code %d", code)
+	}
+	enc, err := os.ReadFile(fEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string, b []byte) string {
+		fname := filepath.Join(dir, name)
+		if err := os.WriteFile(fname, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	tampered := append([]byte(nil), enc...)
+	tampered[100]++
+
+	tests := []struct {
+		name string
+		in   string
+		key  string
+		want int
+	}{
+		{"ok", fEnc, key, 0},
+		{"not encrypted", fPlain, key, 3},
+		{"wrong key", fEnc, "wrong key", 5},
+		{"tampered", write("tampered.aes", tampered), key, 5},
+		{"truncated", write("truncated.aes", enc[:len(enc)/2]), key, 6},
+		{"trailing data", write("trailing.aes", append(append([]byte(nil), enc...), 'x')), key, 7},
+	}
+	for _, tt := range tests {
+		out := filepath.Join(dir, tt.name+".out")
+		if code := runCrypt(t, crypt, tt.key, "-d", "-f", "-in="+tt.in, "-out="+out); code != tt.want {
+			t.Errorf("%s: expected exit code %d, got %d", tt.name, tt.want, code)
+		}
+	}
+}
+
+// buildCrypt builds the crypt binary into `dir` and returns its path
+func buildCrypt(t *testing.T, dir string) string {
+	t.Helper()
+	bin := filepath.Join(dir, "crypt")
+	if output, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("cannot build crypt binary: %v\nOutput: %s", err, output)
+	}
+	return bin
+}
+
+// runCrypt runs the crypt binary with `skey` in the environment and returns its exit code
+func runCrypt(t *testing.T, bin string, skey string, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(bin, args...)
+	cmd.Env = append(os.Environ(), "CRYPTOD_KEY="+skey)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("cannot run crypt: %v", err)
+	}
+	return 0
+}
+
+func TestWrongKeyMessage(t *testing.T) {
+	dir := t.TempDir()
+	crypt := buildCrypt(t, dir)
+
+	fPlain := filepath.Join(dir, "plain.txt")
+	fEnc := filepath.Join(dir, "plain.txt.aes")
+	if err := os.WriteFile(fPlain, generatePlainText(1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCrypt(t, crypt, key, "-e", "-in="+fPlain, "-out="+fEnc); code != 0 {
+		t.Fatalf("encrypt failed with exit code %d", code)
+	}
+
+	cmd := exec.Command(crypt, "-d", "-in="+fEnc, "-out="+filepath.Join(dir, "plain.out"))
+	cmd.Env = append(os.Environ(), "CRYPTOD_KEY=wrong key")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 5 {
+		t.Errorf("expected exit code 5, got %v", err)
+	}
+	if !strings.Contains(string(out), "error -- wrong key") {
+		t.Errorf("expected a wrong key message, got %q", out)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build linux
+// +build linux
+
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+	crypt := buildCrypt(t, dir)
+
+	fPlain := filepath.Join(dir, "plain.txt")
+	fEnc := filepath.Join(dir, "plain.txt.aes")
+	if err := os.WriteFile(fPlain, generatePlainText(1024*1000*2+10), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCrypt(t, crypt, key, "-e", "-in="+fPlain, "-out="+fEnc); code != 0 {
+		t.Fatalf("encrypt failed with exit code %d", code)
+	}
+	enc, err := os.ReadFile(fEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fTrunc := filepath.Join(dir, "truncated.aes")
+	if err := os.WriteFile(fTrunc, enc[:len(enc)-5], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// inspect needs no key
+	cmd := exec.Command(crypt, "inspect", "-json", fEnc, fTrunc)
+	cmd.Env = []string{}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 6 {
+		t.Fatalf("expected exit code 6, got %v", err)
+	}
+
+	var results []map[string]interface{}
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var res map[string]interface{}
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, res)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if results[0]["format"] != "2.0" || results[0]["chunk_count"] != 3.0 || results[0]["end_marker"] != true {
+		t.Errorf("unexpected result: %v", results[0])
+	}
+	if results[1]["end_marker"] != false || results[1]["error"] == nil {
+		t.Errorf("unexpected result for truncated file: %v", results[1])
+	}
+
+	if code := runCrypt(t, crypt, "", "inspect", fEnc); code != 0 {
+		t.Errorf("human output: expected exit code 0, got %d", code)
+	}
+
+	// with several failures, the first sets the exit code
+	fPlainAes := filepath.Join(dir, "notcrypt.aes")
+	if err := os.WriteFile(fPlainAes, []byte("not an encrypted stream"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCrypt(t, crypt, "", "inspect", fTrunc, fPlainAes); code != 6 {
+		t.Errorf("truncated then bad header: expected exit code 6, got %d", code)
+	}
+	if code := runCrypt(t, crypt, "", "inspect", fPlainAes, fTrunc); code != 3 {
+		t.Errorf("bad header then truncated: expected exit code 3, got %d", code)
+	}
+}
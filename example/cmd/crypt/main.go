@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
+
+	"github.com/wiggin77/cryptod"
 )
 
 const usageMessage = "\n" +
@@ -15,6 +18,20 @@ const usageMessage = "\n" +
 	CRYPTOD_KEY=this_is_a_secret crypt -e -in=plaintext.txt -out=crypttext.txt.aes
  - decrypt a file:
 	CRYPTOD_KEY=this_is_a_secret crypt -d -in=crypttext.txt.aes -out=plaintext.txt
+ - show progress while encrypting a large file:
+	CRYPTOD_KEY=this_is_a_secret crypt -e -progress -in=backup.tar
+ - encrypt a large file so that rerunning the same command resumes it if interrupted:
+	CRYPTOD_KEY=this_is_a_secret crypt -e -resume -in=backup.tar
+ - encrypt with a key derived from CRYPTOD_KEY and the file path under a root, unique to the file:
+	CRYPTOD_KEY=this_is_a_secret crypt -e -derive -root=docs -in=docs/2024/report.pdf
+ - encrypt to ASCII armor, for pasting into tickets or email (decrypting detects it):
+	CRYPTOD_KEY=this_is_a_secret crypt -e -a -in=config.yaml
+ - describe an encrypted file (no key needed):
+	crypt inspect crypttext.txt.aes
+ - check encrypted files authenticate, without writing plaintext:
+	CRYPTOD_KEY=this_is_a_secret crypt verify *.aes
+ - salvage a damaged encrypted file:
+	CRYPTOD_KEY=this_is_a_secret crypt recover -in=damaged.tar.aes
 
  The encryption key must be provided via the CRYPTOD_KEY environment variable.
  WARNING: Never pass keys as command-line arguments - they will be visible in
@@ -27,6 +44,10 @@ var (
 	fileIn         string
 	fileOut        string
 	forceOverwrite bool
+	showProgress   bool
+	resumable      bool
+	keys           keyDerivation
+	armor          bool
 )
 
 func init() {
@@ -35,9 +56,25 @@ func init() {
 	flag.StringVar(&fileIn, "in", "", "input file")
 	flag.StringVar(&fileOut, "out", "", "output file")
 	flag.BoolVar(&forceOverwrite, "f", false, "force overwrite of output file")
+	flag.BoolVar(&showProgress, "progress", false, "show progress on stderr when it is a terminal")
+	flag.BoolVar(&resumable, "resume", false, "save checkpoints while running, and resume from one if present")
+	keys.register(flag.CommandLine)
+	flag.BoolVar(&armor, "a", false, "encrypt to ASCII armor; decryption detects it")
 }
 
 func main() {
+	// subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "inspect":
+			os.Exit(inspectCmd(os.Args[2:], os.Stdout, os.Stderr))
+		case "verify":
+			os.Exit(verifyCmd(os.Args[2:], os.Getenv("CRYPTOD_KEY"), os.Stdout, os.Stderr))
+		case "recover":
+			os.Exit(recoverCmd(os.Args[2:], os.Getenv("CRYPTOD_KEY"), os.Stdout, os.Stderr))
+		}
+	}
+
 	flag.Usage = help
 	flag.Parse()
 
@@ -47,6 +84,17 @@ func main() {
 		flag.Usage()
 	}
 
+	// armored output has no checkpoints to resume from
+	if armor && modeEncrypt && resumable {
+		printError("-a cannot be combined with -resume")
+		flag.Usage()
+	}
+
+	if err := keys.check(); err != nil {
+		printError(err)
+		flag.Usage()
+	}
+
 	fileIn = expandTilde(fileIn)
 	fileOut = expandTilde(fileOut)
 
@@ -68,16 +116,39 @@ func main() {
 		fileOut = inferOutputFile(modeEncrypt, fileIn)
 	}
 
-	// output file should not exist (unless force overwrite flag is present)
-	if _, err := os.Stat(fileOut); err == nil && !forceOverwrite {
+	// output file should not exist (unless force overwrite flag is present,
+	// or it is being resumed)
+	resuming := false
+	if resumable {
+		_, err := os.Stat(checkpointFile(fileOut))
+		resuming = err == nil
+	}
+	if _, err := os.Stat(fileOut); err == nil && !forceOverwrite && !resuming {
 		printError("output file exists without force overwrite: ", fileOut)
 		flag.Usage()
 	}
 
-	err := cmd(modeEncrypt, fileIn, fileOut, skey)
+	var opts []cryptod.Option
+	if showProgress && isTerminal(os.Stderr) {
+		opts = append(opts, cryptod.WithProgress(newProgressPrinter(os.Stderr).update))
+	}
+	if armor && modeEncrypt {
+		opts = append(opts, cryptod.WithArmor(""))
+	}
+
+	key, err := keys.key(skey, fileIn, !modeEncrypt)
 	if err != nil {
 		printError(err)
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+	err = cmd(modeEncrypt, fileIn, fileOut, key, resumable, opts...)
+	key.Destroy()
+	if err != nil {
+		printError(errorText(err))
+		if errors.Is(err, cryptod.ErrWrongKey) {
+			fmt.Fprintln(os.Stderr, keys.keyHint())
+		}
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -85,7 +156,7 @@ func help() {
 	fmt.Fprint(os.Stderr, usageMessage)
 	fmt.Fprintln(os.Stderr, "Flags:")
 	flag.PrintDefaults()
-	os.Exit(2)
+	os.Exit(exitUsage)
 }
 
 func printError(a ...interface{}) {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/wiggin77/cryptod"
+)
+
+// progressInterval limits how often the progress line is redrawn
+const progressInterval = 200 * time.Millisecond
+
+// progressPrinter renders percent done, rate and ETA on a single terminal line
+type progressPrinter struct {
+	out   io.Writer
+	start time.Time
+	last  time.Time
+}
+
+func newProgressPrinter(out io.Writer) *progressPrinter {
+	return &progressPrinter{out: out, start: time.Now()}
+}
+
+// update is installed as the cryptod progress hook
+func (pp *progressPrinter) update(p cryptod.Progress) {
+	now := time.Now()
+	if !p.Done && now.Sub(pp.last) < progressInterval {
+		return
+	}
+	pp.last = now
+
+	elapsed := now.Sub(pp.start).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(p.PlaintextBytes) / elapsed
+	}
+
+	line := fmt.Sprintf("%s  %s/s", formatBytes(float64(p.PlaintextBytes)), formatBytes(rate))
+	if frac := p.Fraction(); frac >= 0 {
+		eta := "--:--"
+		if frac > 0 {
+			eta = formatDuration(time.Duration(elapsed * (1 - frac) / frac * float64(time.Second)))
+		}
+		line = fmt.Sprintf("%5.1f%%  %s  ETA %s", frac*100, line, eta)
+	}
+
+	// pad to overwrite any longer previous line
+	fmt.Fprintf(pp.out, "\r%-60s", line)
+	if p.Done {
+		fmt.Fprintln(pp.out)
+	}
+}
+
+// isTerminal reports whether `f` is attached to a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// formats a byte count or rate using binary units
+func formatBytes(n float64) string {
+	const unit = 1024
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= unit && i < len(units)-1 {
+		n /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// formats a duration as h:mm:ss or m:ss
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	s := int(d % time.Minute / time.Second)
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
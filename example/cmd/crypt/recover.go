@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wiggin77/cryptod"
+)
+
+const recoverUsageMessage = "\n" +
+	`Usage of 'crypt recover'
+ - salvage what can be decrypted from a damaged file, skipping bad chunks:
+	CRYPTOD_KEY=this_is_a_secret crypt recover -in=damaged.tar.aes -out=damaged.tar
+ - write zeros in place of lost chunks, so offsets are preserved:
+	CRYPTOD_KEY=this_is_a_secret crypt recover -zero -in=disk.img.aes
+ - salvage a file encrypted with -derive:
+	CRYPTOD_KEY=this_is_a_secret crypt recover -derive -root=docs -in=docs/report.pdf.aes
+`
+
+// recoverCmd runs `crypt recover` and returns the exit code
+func recoverCmd(args []string, skey string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("recover", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	in := fs.String("in", "", "damaged encrypted file")
+	out := fs.String("out", "", "output file")
+	force := fs.Bool("f", false, "force overwrite of output file")
+	zero := fs.Bool("zero", false, "fill lost chunks with zeros")
+	var keys keyDerivation
+	keys.register(fs)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, recoverUsageMessage)
+		fmt.Fprintln(stderr, "Flags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || *in == "" {
+		if err == nil {
+			fs.Usage()
+		}
+		return exitUsage
+	}
+	if err := keys.check(); err != nil {
+		fmt.Fprintln(stderr, "error --", err)
+		return exitUsage
+	}
+	if skey == "" {
+		fmt.Fprintln(stderr, "error -- missing secret key - set CRYPTOD_KEY environment variable")
+		return exitUsage
+	}
+
+	fileIn := expandTilde(*in)
+	fileOut := expandTilde(*out)
+	if fileOut == "" {
+		fileOut = inferOutputFile(false, fileIn)
+	}
+	if _, err := os.Stat(fileOut); err == nil && !*force {
+		fmt.Fprintln(stderr, "error -- output file exists without force overwrite:", fileOut)
+		return exitUsage
+	}
+
+	var opts []cryptod.Option
+	if *zero {
+		opts = append(opts, cryptod.WithZeroFill())
+	}
+	key, err := keys.key(skey, fileIn, true)
+	if err != nil {
+		fmt.Fprintln(stderr, "error --", err)
+		return exitUsage
+	}
+	defer key.Destroy()
+	report, err := recoverFile(fileIn, fileOut, key, opts...)
+	if err != nil {
+		fmt.Fprintln(stderr, "error --", errorText(err))
+		if errors.Is(err, cryptod.ErrWrongKey) {
+			fmt.Fprintln(stderr, keys.keyHint())
+		}
+		return exitCode(err)
+	}
+	printRecoveryReport(stdout, fileOut, report)
+	if !report.Intact() {
+		return exitDataLost
+	}
+	return exitOK
+}
+
+// recoverFile recovers the encrypted file `fileIn` into `fileOut`. The output
+// is kept whatever was lost.
+func recoverFile(fileIn string, fileOut string, key *cryptod.Key, opts ...cryptod.Option) (*cryptod.RecoveryReport, error) {
+	r, err := os.Open(fileIn)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(fileOut, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	report, err := cryptod.RecoverWithKey(r, w, key, opts...)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return report, err
+}
+
+// printRecoveryReport prints what was recovered and what was lost
+func printRecoveryReport(w io.Writer, fileOut string, report *cryptod.RecoveryReport) {
+	fmt.Fprintf(w, "recovered %d chunks (%d bytes) into %s\n", report.Chunks, report.PlaintextBytes, fileOut)
+	for _, l := range report.Lost {
+		size := "unknown size"
+		if l.PlaintextSize >= 0 {
+			size = fmt.Sprintf("%d bytes", l.PlaintextSize)
+		}
+		fmt.Fprintf(w, "lost: encrypted bytes %d-%d, %d chunks from chunk %d, plaintext at offset %d (%s)\n",
+			l.Offset, l.Offset+l.Size, l.Chunks, l.FirstChunk, l.PlaintextOffset, size)
+	}
+	if !report.EndMarker {
+		fmt.Fprintln(w, "end of stream marker not found: data at the end may be missing")
+	}
+}
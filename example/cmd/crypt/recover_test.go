@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package main_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	crypt := buildCrypt(t, dir)
+
+	const chunk = 1024 * 1000
+	plain := generatePlainText(chunk*3 + 10)
+	fPlain := filepath.Join(dir, "plain.txt")
+	fEnc := filepath.Join(dir, "plain.txt.aes")
+	if err := os.WriteFile(fPlain, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCrypt(t, crypt, key, "-e", "-in="+fPlain, "-out="+fEnc); code != 0 {
+		t.Fatalf("encrypt failed with exit code %d", code)
+	}
+
+	// intact files recover completely
+	fOut := filepath.Join(dir, "intact.out")
+	if code := runCrypt(t, crypt, key, "recover", "-in="+fEnc, "-out="+fOut); code != 0 {
+		t.Errorf("intact: expected exit code 0, got %d", code)
+	}
+
+	// damage the second chunk
+	enc, err := os.ReadFile(fEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc[chunk+chunk/2]++
+	fDamaged := filepath.Join(dir, "damaged.aes")
+	if err := os.WriteFile(fDamaged, enc, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runCrypt(t, crypt, key, "-d", "-in="+fDamaged, "-out="+filepath.Join(dir, "damaged.out")); code != 5 {
+		t.Errorf("decrypt: expected exit code 5, got %d", code)
+	}
+
+	fOut = filepath.Join(dir, "recovered.out")
+	if code := runCrypt(t, crypt, key, "recover", "-zero", "-in="+fDamaged, "-out="+fOut); code != 9 {
+		t.Errorf("damaged: expected exit code 9, got %d", code)
+	}
+	got, err := os.ReadFile(fOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append([]byte(nil), plain[:chunk]...), make([]byte, chunk)...), plain[2*chunk:]...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("recovered %d bytes that do not match the surviving chunks", len(got))
+	}
+}
@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package main_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wiggin77/cryptod"
+)
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	crypt := buildCrypt(t, dir)
+
+	plain := generatePlainText(1024*1000*3 + 10)
+	fPlain := filepath.Join(dir, "plain.txt")
+	fEnc := filepath.Join(dir, "plain.txt.aes")
+	if err := os.WriteFile(fPlain, plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a run interrupted part way through the third chunk
+	var cp *cryptod.Checkpoint
+	full := &bytes.Buffer{}
+	err := cryptod.Encrypt(bytes.NewReader(plain), full, key, cryptod.WithCheckpoint(func(c *cryptod.Checkpoint) error {
+		if c.Chunk == 3 {
+			cp = c
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := cp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fEnc+".checkpoint", b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fEnc, full.Bytes()[:cp.OutputOffset+100], 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := runCrypt(t, crypt, key, "-e", "-resume", "-in="+fPlain, "-out="+fEnc); code != 0 {
+		t.Fatalf("resume failed with exit code %d", code)
+	}
+	if _, err := os.Stat(fEnc + ".checkpoint"); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not removed after success: %v", err)
+	}
+
+	fOut := filepath.Join(dir, "plain.out")
+	if code := runCrypt(t, crypt, key, "-d", "-in="+fEnc, "-out="+fOut); code != 0 {
+		t.Fatalf("decrypt failed with exit code %d", code)
+	}
+	got, err := os.ReadFile(fOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("resumed output does not decrypt to the input")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/wiggin77/cryptod"
+)
+
+const verifyUsageMessage = "\n" +
+	`Usage of 'crypt verify'
+ - check that encrypted files decrypt cleanly, without writing any plaintext:
+	CRYPTOD_KEY=this_is_a_secret crypt verify backup1.tar.aes backup2.tar.aes
+ - check files encrypted with -derive, each with its own key:
+	CRYPTOD_KEY=this_is_a_secret crypt verify -derive -root=docs docs/*.aes
+`
+
+// verifyResult is the outcome of verifying one file
+type verifyResult struct {
+	report *cryptod.VerifyReport
+	err    error
+}
+
+// verifyCmd runs `crypt verify` and returns the exit code
+func verifyCmd(args []string, skey string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	jobs := fs.Int("j", runtime.NumCPU(), "number of files to verify at once")
+	var keys keyDerivation
+	keys.register(fs)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, verifyUsageMessage)
+		fmt.Fprintln(stderr, "Flags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		if err == nil {
+			fs.Usage()
+		}
+		return exitUsage
+	}
+	if err := keys.check(); err != nil {
+		fmt.Fprintln(stderr, "error --", err)
+		return exitUsage
+	}
+	if skey == "" {
+		fmt.Fprintln(stderr, "error -- missing secret key - set CRYPTOD_KEY environment variable")
+		return exitUsage
+	}
+
+	files := fs.Args()
+	results := verifyFiles(files, skey, &keys, *jobs)
+
+	code := exitOK
+	failed := 0
+	wrongKey := false
+	for i, res := range results {
+		if res.err != nil {
+			failed++
+			wrongKey = wrongKey || errors.Is(res.err, cryptod.ErrWrongKey)
+			if code == exitOK {
+				code = exitCode(res.err)
+			}
+			fmt.Fprintf(stdout, "FAIL  %s: %s\n", files[i], errorText(res.err))
+			continue
+		}
+		fmt.Fprintf(stdout, "ok    %s (format %s, %d chunks, %s)\n", files[i], res.report.Format,
+			res.report.Chunks, formatBytes(float64(res.report.PlaintextBytes)))
+	}
+	fmt.Fprintf(stdout, "%d passed, %d failed\n", len(files)-failed, failed)
+	if wrongKey {
+		fmt.Fprintln(stderr, keys.keyHint())
+	}
+	return code
+}
+
+// verifyFiles verifies `files` on up to `jobs` goroutines and returns the
+// results in the same order
+func verifyFiles(files []string, skey string, keys *keyDerivation, jobs int) []verifyResult {
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]verifyResult, len(files))
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				results[i].report, results[i].err = verifyFile(expandTilde(files[i]), skey, keys)
+			}
+		}()
+	}
+	for i := range files {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+	return results
+}
+
+// verifyFile verifies the encrypted file `name`
+func verifyFile(name string, skey string, keys *keyDerivation) (*cryptod.VerifyReport, error) {
+	key, err := keys.key(skey, name, true)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Destroy()
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return cryptod.VerifyWithKey(f, key)
+}
@@ -0,0 +1,73 @@
+//go:build linux
+// +build linux
+
+package main_test
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	crypt := buildCrypt(t, dir)
+
+	var files []string
+	for _, name := range []string{"a", "b", "c"} {
+		fPlain := filepath.Join(dir, name)
+		if err := os.WriteFile(fPlain, generatePlainText(1024*1000+10), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if code := runCrypt(t, crypt, key, "-e", "-in="+fPlain); code != 0 {
+			t.Fatalf("encrypt failed with exit code %d", code)
+		}
+		files = append(files, fPlain+".aes")
+	}
+
+	run := func(args ...string) (int, string) {
+		cmd := exec.Command(crypt, append([]string{"verify"}, args...)...)
+		cmd.Env = append(os.Environ(), "CRYPTOD_KEY="+key)
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		err := cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), out.String()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return 0, out.String()
+	}
+
+	code, out := run(files...)
+	if code != 0 || !strings.Contains(out, "3 passed, 0 failed") {
+		t.Errorf("expected all files to pass, got exit code %d:\n%s", code, out)
+	}
+
+	// tamper with the second file
+	enc, err := os.ReadFile(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc[len(enc)/2]++
+	if err := os.WriteFile(files[1], enc, 0600); err != nil {
+		t.Fatal(err)
+	}
+	code, out = run(files...)
+	if code != 5 || !strings.Contains(out, "2 passed, 1 failed") || !strings.Contains(out, "FAIL  "+files[1]) {
+		t.Errorf("expected the tampered file to fail, got exit code %d:\n%s", code, out)
+	}
+
+	// no plaintext files are created
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 {
+		t.Errorf("expected only the inputs, encrypted files and binary, found %d entries", len(entries))
+	}
+}
@@ -0,0 +1,209 @@
+package cryptod
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Format identifies a version of the encrypted stream format. It is recorded
+// in every stream header, and Decrypt uses it to pick the matching decoder, so
+// streams written in older formats remain readable.
+type Format struct {
+	Major uint8
+	Minor uint8
+}
+
+// FormatV1 is the original stream format. It is deprecated: its 32-bit
+// chunk counter is bounded and its end of stream marker is not
+// authenticated. Decrypt still reads it.
+var FormatV1 = Format{Major: 1, Minor: 0}
+
+// defaultFormat is the format written when no WithFormat option is given
+var defaultFormat = FormatV2
+
+func (f Format) String() string {
+	return fmt.Sprintf("%d.%d", f.Major, f.Minor)
+}
+
+// MarshalText encodes the format as "major.minor".
+func (f Format) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText parses a format written as "major.minor", rejecting anything
+// else, such as trailing text.
+func (f *Format) UnmarshalText(b []byte) error {
+	major, minor, ok := strings.Cut(string(b), ".")
+	ma, err1 := strconv.ParseUint(major, 10, 8)
+	mi, err2 := strconv.ParseUint(minor, 10, 8)
+	if !ok || err1 != nil || err2 != nil {
+		return fmt.Errorf("invalid format %q", b)
+	}
+	f.Major, f.Minor = uint8(ma), uint8(mi)
+	return nil
+}
+
+// WithFormat selects the format version Encrypt writes, e.g. to keep writing
+// an older format during a rolling upgrade while some readers only
+// understand it. Decrypt always reads any registered format, whatever this
+// option says.
+func WithFormat(f Format) Option {
+	return func(o *options) {
+		o.format = f
+	}
+}
+
+// WithoutDeprecated refuses to write or read formats marked deprecated,
+// failing with ErrDeprecatedFormat instead.
+func WithoutDeprecated() Option {
+	return func(o *options) {
+		o.noDeprecated = true
+	}
+}
+
+// WithKeyCommitment refuses to write or read formats whose header does not
+// commit to the key, failing with ErrUnsupportedVersion instead. Format 1.0
+// does not: a 1.0 stream can be crafted to decrypt under two chosen keys, so
+// a service that tries several keys on untrusted input, and shows which one
+// worked, can be made to reveal its keys one guess at a time. Such services
+// should set this option, or WithoutDeprecated.
+func WithKeyCommitment() Option {
+	return func(o *options) {
+		o.keyCommitment = true
+	}
+}
+
+// aadBufs recycles the AAD buffers of codecs, so sealing and opening a chunk
+// does not allocate. Put a buffer back once the AAD is used.
+var aadBufs = sync.Pool{New: func() any { return new([]byte) }}
+
+// encoder seals the chunks of one stream in a particular format. seal must be
+// safe for concurrent use.
+type encoder interface {
+	// header returns the stream header to write
+	header() *header
+	// nonceSize returns the size of chunk nonces
+	nonceSize() int
+	// overhead returns the number of bytes sealing adds to a chunk
+	overhead() int
+	// seal encrypts `p` into `dst` as chunk number `ctr`, filling `nonce`
+	seal(dst []byte, nonce []byte, p []byte, ctr uint64) ([]byte, error)
+	// sealTomb returns the payload of the end of stream marker following
+	// chunk `ctr-1`, filling `nonce`
+	sealTomb(dst []byte, nonce []byte, ctr uint64) ([]byte, error)
+}
+
+// decoder opens the chunks of one stream in a particular format. open must
+// be safe for concurrent use.
+type decoder interface {
+	// overhead returns the number of bytes sealing added to a chunk
+	overhead() int
+	// open authenticates and decrypts chunk number `ctr` in place
+	open(c []byte, nonce []byte, ctr uint64) ([]byte, error)
+	// openTomb authenticates the end of stream marker following chunk `ctr-1`
+	openTomb(c []byte, nonce []byte, ctr uint64) error
+	// counter returns the chunk counter recorded in `nonce`, if the format
+	// records one. It is not authenticated until the chunk is opened.
+	counter(nonce []byte) (uint64, bool)
+	// variableChunks reports whether chunks before the last may be short
+	variableChunks() bool
+}
+
+// formatSpec describes how to write and read one format of one scheme
+type formatSpec struct {
+	scheme     string
+	format     Format
+	deprecated bool
+	committing bool // the header commits to the key
+	// newEncoder starts a new stream, or continues the stream with header
+	// `h` when resuming from a checkpoint
+	newEncoder func(h *header, key *Key, o *options) (encoder, error)
+	newDecoder func(h *header, key *Key, o *options) (decoder, error)
+	// describe, if set, adds format specific details of header `h` to `info`
+	describe func(h *header, info *StreamInfo)
+}
+
+type formatKey struct {
+	scheme string
+	format Format
+}
+
+var (
+	formatsMux sync.RWMutex
+	formats    = map[formatKey]*formatSpec{}
+)
+
+// registerFormat makes a format available to Encrypt and Decrypt
+func registerFormat(spec *formatSpec) {
+	formatsMux.Lock()
+	defer formatsMux.Unlock()
+	formats[formatKey{spec.scheme, spec.format}] = spec
+}
+
+// unregisterFormat removes a format registered with registerFormat
+func unregisterFormat(scheme string, f Format) {
+	formatsMux.Lock()
+	defer formatsMux.Unlock()
+	delete(formats, formatKey{scheme, f})
+}
+
+// lookupFormat returns the registered spec for format `f` of `scheme`
+func lookupFormat(scheme string, f Format) (*formatSpec, error) {
+	formatsMux.RLock()
+	defer formatsMux.RUnlock()
+	spec, ok := formats[formatKey{scheme, f}]
+	if !ok {
+		return nil, fmt.Errorf("%w: scheme %q format %s", ErrUnsupportedVersion, scheme, f)
+	}
+	return spec, nil
+}
+
+// checkPolicy returns an error if the options forbid using `spec`
+func (spec *formatSpec) checkPolicy(o *options) error {
+	if spec.deprecated && o.noDeprecated {
+		return fmt.Errorf("%w: scheme %q format %s", ErrDeprecatedFormat, spec.scheme, spec.format)
+	}
+	if !spec.committing && o.keyCommitment {
+		return errNotSupported(spec.format, "key commitment")
+	}
+	return nil
+}
+
+// newStreamEncoder returns an encoder for the format selected by `o`, or for
+// the format named by header `h` of a stream being resumed
+func newStreamEncoder(h *header, key *Key, o *options) (encoder, error) {
+	s, f := scheme, o.format
+	if h != nil {
+		s, f = string(h.scheme[:]), h.format()
+	}
+	spec, err := lookupFormat(s, f)
+	if err != nil {
+		return nil, err
+	}
+	if err := spec.checkPolicy(o); err != nil {
+		return nil, err
+	}
+	return spec.newEncoder(h, key, o)
+}
+
+// newStreamDecoder returns a decoder for the format named by header `h`
+func newStreamDecoder(h *header, key *Key, o *options) (decoder, error) {
+	spec, err := lookupFormat(string(h.scheme[:]), h.format())
+	if err != nil {
+		return nil, err
+	}
+	if err := spec.checkPolicy(o); err != nil {
+		return nil, err
+	}
+	return spec.newDecoder(h, key, o)
+}
+
+// errExtraHeader is returned by formats that take no format specific header fields
+var errExtraHeader = fmt.Errorf("%w: unexpected header fields", ErrBadHeader)
+
+// errNotSupported is returned by formats that lack `feature`
+func errNotSupported(f Format, feature string) error {
+	return fmt.Errorf("%w: format %s does not support %s", ErrUnsupportedVersion, f, feature)
+}
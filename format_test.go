@@ -0,0 +1,156 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// legacyFormat is a deprecated format registered by tests. It seals chunks
+// like format 1.0 but is named differently in the header.
+var legacyFormat = Format{Major: 0, Minor: 9}
+
+type legacyCodec struct {
+	v1Codec
+}
+
+func (l legacyCodec) header() *header {
+	h := &header{}
+	h.set(scheme, legacyFormat, nil)
+	return h
+}
+
+func registerLegacyFormat(t *testing.T) {
+	registerFormat(&formatSpec{
+		scheme:     scheme,
+		format:     legacyFormat,
+		deprecated: true,
+		newEncoder: func(h *header, key *Key, o *options) (encoder, error) {
+			gcm, err := getGCM(key)
+			if err != nil {
+				return nil, err
+			}
+			return legacyCodec{v1Codec{gcm: gcm}}, nil
+		},
+		newDecoder: func(h *header, key *Key, o *options) (decoder, error) {
+			gcm, err := getGCM(key)
+			if err != nil {
+				return nil, err
+			}
+			return legacyCodec{v1Codec{gcm: gcm}}, nil
+		},
+	})
+	t.Cleanup(func() { unregisterFormat(scheme, legacyFormat) })
+}
+
+func TestFormatDispatch(t *testing.T) {
+	registerLegacyFormat(t)
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize + 100)
+
+	for _, f := range []Format{FormatV1, legacyFormat} {
+		buf := &bytes.Buffer{}
+		if err := Encrypt(bytes.NewReader(plaintext), buf, key, WithFormat(f)); err != nil {
+			t.Fatalf("format %s: encrypt error: %v", f, err)
+		}
+		h := header{}
+		if err := h.read(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("format %s: header error: %v", f, err)
+		}
+		if h.format() != f {
+			t.Errorf("format %s: header names format %s", f, h.format())
+		}
+
+		out := &bytes.Buffer{}
+		if err := Decrypt(buf, out, key); err != nil {
+			t.Fatalf("format %s: decrypt error: %v", f, err)
+		}
+		if !bytes.Equal(plaintext, out.Bytes()) {
+			t.Errorf("format %s: plaintext mismatch", f)
+		}
+	}
+}
+
+func TestFormatDeprecated(t *testing.T) {
+	registerLegacyFormat(t)
+	const key = "secret key"
+
+	err := Encrypt(bytes.NewReader([]byte("data")), io.Discard, key, WithFormat(legacyFormat), WithoutDeprecated())
+	if !errors.Is(err, ErrDeprecatedFormat) {
+		t.Errorf("encrypt: expected ErrDeprecatedFormat, got %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader([]byte("data")), buf, key, WithFormat(legacyFormat)); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	legacy := buf.Bytes()
+
+	for _, workers := range []int{1, 4} {
+		err = Decrypt(bytes.NewReader(legacy), io.Discard, key, WithoutDeprecated(), WithConcurrency(workers))
+		if !errors.Is(err, ErrDeprecatedFormat) || !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("workers=%d: expected ErrDeprecatedFormat, got %v", workers, err)
+		}
+		if err := Decrypt(bytes.NewReader(legacy), io.Discard, key, WithConcurrency(workers)); err != nil {
+			t.Errorf("workers=%d: decrypt without policy: %v", workers, err)
+		}
+	}
+}
+
+func TestFormatKeyCommitment(t *testing.T) {
+	const key = "secret key"
+	err := Encrypt(bytes.NewReader([]byte("data")), io.Discard, key, WithFormat(FormatV1), WithKeyCommitment())
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("encrypt: expected ErrUnsupportedVersion, got %v", err)
+	}
+
+	for _, f := range []Format{FormatV1, FormatV2} {
+		buf := &bytes.Buffer{}
+		if err := Encrypt(bytes.NewReader([]byte("data")), buf, key, WithFormat(f)); err != nil {
+			t.Fatalf("format %s: encrypt error: %v", f, err)
+		}
+		err := Decrypt(buf, io.Discard, key, WithKeyCommitment())
+		if want := f == FormatV2; (err == nil) != want || (!want && !errors.Is(err, ErrUnsupportedVersion)) {
+			t.Errorf("format %s: decrypt with key commitment returned %v", f, err)
+		}
+	}
+}
+
+func TestFormatText(t *testing.T) {
+	for _, f := range []Format{FormatV1, FormatV2, {Major: 255, Minor: 12}} {
+		b, _ := f.MarshalText()
+		var got Format
+		if err := got.UnmarshalText(b); err != nil || got != f {
+			t.Errorf("%s: round trip gave %s, %v", f, got, err)
+		}
+	}
+	for _, s := range []string{"", "2", "2.", ".0", "2.0x", "2.0.1", "2,0", " 2.0", "-1.0", "256.0", "2.0 "} {
+		var f Format
+		if err := f.UnmarshalText([]byte(s)); err == nil {
+			t.Errorf("%q: expected an error, got %s", s, f)
+		}
+	}
+}
+
+func TestFormatUnknown(t *testing.T) {
+	err := Encrypt(bytes.NewReader([]byte("data")), io.Discard, "key", WithFormat(Format{Major: 99}))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestFormatV1ExtraHeader(t *testing.T) {
+	h := &header{}
+	h.set(scheme, FormatV1, []byte{1, 2, 3})
+	buf := &bytes.Buffer{}
+	if err := h.write(buf); err != nil {
+		t.Fatal(err)
+	}
+	writeChunkHeader(chunkHeader{nonce: make([]byte, 12), tomb: true}, buf)
+
+	err := Decrypt(buf, io.Discard, "key")
+	if !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected ErrBadHeader, got %v", err)
+	}
+}
@@ -15,8 +15,6 @@ const (
 
 	magic  = "sc"
 	scheme = "aes256gcm"
-	verMaj = byte(1)
-	verMin = byte(0)
 )
 
 // header for encrypted files
@@ -27,46 +25,53 @@ type header struct {
 	scheme [schemeSize]byte
 	verMaj [verMajSize]byte
 	verMin [verMinSize]byte
+	ext    []byte // format specific fields, empty for format 1.0
 }
 
 // initializes the header with valid values
 func (h *header) init() {
-	h.size[0] = headerSize
+	h.set(scheme, FormatV1, nil)
+}
+
+// initializes the header for format `f` of `scheme`, followed by the format
+// specific fields `ext`
+func (h *header) set(scheme string, f Format, ext []byte) {
+	h.size[0] = byte(headerSize + len(ext))
 	copy(h.magic[:], magic)
 	copy(h.scheme[:], scheme)
-	h.verMaj[0] = verMaj
-	h.verMin[0] = verMin
+	h.verMaj[0] = f.Major
+	h.verMin[0] = f.Minor
+	h.ext = ext
 }
 
-// validates the contents of header
-func (h *header) validate() error {
-	if !bytes.Equal(h.size[:], []byte{headerSize}) {
-		return fmt.Errorf("expected header size %d, got %v", headerSize, h.size)
-	}
+// returns the format version named by the header
+func (h *header) format() Format {
+	return Format{Major: h.verMaj[0], Minor: h.verMin[0]}
+}
 
+// validates the contents of header, and that it names a registered format
+func (h *header) validate() error {
 	if !bytes.Equal(h.magic[:], []byte(magic)) {
-		return fmt.Errorf("expected magic %s, got %v", magic, h.magic)
+		return fmt.Errorf("%w: expected magic %s, got %v", ErrBadHeader, magic, h.magic)
 	}
 
-	if !bytes.Equal(h.scheme[:], []byte(scheme)) {
-		return fmt.Errorf("expected scheme %s, got %v", scheme, h.scheme)
+	if int(h.size[0]) != headerSize+len(h.ext) {
+		return fmt.Errorf("%w: expected header size %d, got %v", ErrBadHeader, headerSize+len(h.ext), h.size)
 	}
 
-	if !bytes.Equal(h.verMaj[:], []byte{verMaj}) {
-		return fmt.Errorf("expected verMaj %d, got %v", verMaj, h.verMaj)
-	}
+	_, err := lookupFormat(string(h.scheme[:]), h.format())
+	return err
+}
 
-	if !bytes.Equal(h.verMin[:], []byte{verMin}) {
-		return fmt.Errorf("expected verMin %d, got %v", verMin, h.verMin)
-	}
-	return nil
+// returns the fields of the header in the order they are written
+func (h *header) fields() [][]byte {
+	return [][]byte{h.size[:], h.magic[:], h.scheme[:], h.verMaj[:], h.verMin[:], h.ext}
 }
 
 // writes the header to `w`
 func (h *header) write(w io.Writer) error {
 	var err error
-	fields := [][]byte{h.size[:], h.magic[:], h.scheme[:], h.verMaj[:], h.verMin[:]}
-	for _, f := range fields {
+	for _, f := range h.fields() {
 		if _, err = w.Write(f); err != nil {
 			return err
 		}
@@ -74,17 +79,82 @@ func (h *header) write(w io.Writer) error {
 	return nil
 }
 
-// reads a header from `r`
+// reads a header from `r` and validates it
 func (h *header) read(r io.Reader) error {
-	fields := [][]byte{h.size[:], h.magic[:], h.scheme[:], h.verMaj[:], h.verMin[:]}
+	if err := h.parse(r); err != nil {
+		return err
+	}
+	return h.validate()
+}
+
+// reads a header from `r` without checking that its format is registered.
+// The fixed fields are read first; the size field then determines how many
+// format specific bytes follow.
+func (h *header) parse(r io.Reader) error {
+	h.ext = nil
+	for _, f := range h.fields() {
+		if _, err := io.ReadFull(r, f); err != nil {
+			return truncated(err)
+		}
+	}
+	if !bytes.Equal(h.magic[:], []byte(magic)) {
+		return fmt.Errorf("%w: expected magic %s, got %v", ErrBadHeader, magic, h.magic)
+	}
+	if int(h.size[0]) < headerSize {
+		return fmt.Errorf("%w: expected header size at least %d, got %v", ErrBadHeader, headerSize, h.size)
+	}
+	if n := int(h.size[0]) - headerSize; n > 0 {
+		h.ext = make([]byte, n)
+		if _, err := io.ReadFull(r, h.ext); err != nil {
+			return truncated(err)
+		}
+	}
+	return nil
+}
+
+// returns the header as written to a stream
+func (h *header) marshal() []byte {
+	var b []byte
+	for _, f := range h.fields() {
+		b = append(b, f...)
+	}
+	return b
+}
+
+// headerField is a format specific header field, encoded in the header's
+// extension as a type byte, a length byte and the value
+type headerField struct {
+	typ byte
+	val []byte
+}
+
+// marshalFields encodes `fields` for a header extension
+func marshalFields(fields ...headerField) []byte {
+	var b []byte
 	for _, f := range fields {
-		n, err := r.Read(f)
-		if n != len(f) {
-			return fmt.Errorf("wrong number of byte read, expected %d, got %d", len(f), n)
+		b = append(b, f.typ, byte(len(f.val)))
+		b = append(b, f.val...)
+	}
+	return b
+}
+
+// parseFields decodes the fields of a header extension. Fields of a type not
+// in `known`, and repeated fields, are rejected.
+func parseFields(ext []byte, known ...byte) (map[byte][]byte, error) {
+	fields := make(map[byte][]byte)
+	for len(ext) > 0 {
+		if len(ext) < 2 || len(ext) < 2+int(ext[1]) {
+			return nil, fmt.Errorf("%w: malformed header field", ErrBadHeader)
 		}
-		if err != nil && err != io.EOF {
-			return err
+		typ, val := ext[0], ext[2:2+int(ext[1])]
+		if !bytes.Contains(known, []byte{typ}) {
+			return nil, fmt.Errorf("%w: unknown header field %q", ErrBadHeader, typ)
 		}
+		if _, ok := fields[typ]; ok {
+			return nil, fmt.Errorf("%w: repeated header field %q", ErrBadHeader, typ)
+		}
+		fields[typ] = val
+		ext = ext[2+len(val):]
 	}
-	return h.validate()
+	return fields, nil
 }
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"io"
 	"testing"
+	"testing/iotest"
 )
 
 func TestHeaderInit(t *testing.T) {
@@ -40,6 +41,21 @@ func TestHeaderReadWrite(t *testing.T) {
 	}
 }
 
+func TestHeaderReadShortReads(t *testing.T) {
+	h := &header{}
+	h.init()
+
+	buf := &bytes.Buffer{}
+	if err := h.write(buf); err != nil {
+		t.Error("error on write: ", err)
+	}
+
+	h2 := header{}
+	if err := h2.read(iotest.OneByteReader(buf)); err != nil {
+		t.Error("error on read: ", err)
+	}
+}
+
 func TestHeaderReadGibberish(t *testing.T) {
 	// create random input data
 	buf := make([]byte, headerSize)
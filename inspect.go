@@ -0,0 +1,117 @@
+package cryptod
+
+import (
+	"io"
+	"strings"
+)
+
+// StreamInfo describes the layout of an encrypted stream, as reported by
+// Inspect.
+type StreamInfo struct {
+	Scheme     string `json:"scheme"`
+	Format     Format `json:"format"`
+	Supported  bool   `json:"supported"`  // a decoder is registered for the scheme and format
+	Deprecated bool   `json:"deprecated"` // the format is only kept for reading old streams
+	HeaderSize int64  `json:"header_size"`
+
+	// Deterministic is set if the stream was written with WithDeterministic,
+	// so equal plaintexts under its key give equal streams.
+	Deterministic bool `json:"deterministic,omitempty"`
+	// ContentDefined is set if chunk boundaries were chosen by content with
+	// WithContentDefinedChunking, so chunks before the last may be short.
+	ContentDefined bool `json:"content_defined,omitempty"`
+	// RawKey is set if the stream was encrypted with a raw key, see NewRawKey.
+	RawKey bool `json:"raw_key,omitempty"`
+	// Armored is set if the stream is ASCII armor, see WithArmor. Sizes and
+	// offsets are then those of the binary stream inside it.
+	Armored bool `json:"armored,omitempty"`
+
+	Chunks         []ChunkInfo `json:"chunks"`
+	ChunkCount     uint64      `json:"chunk_count"`
+	CiphertextSize int64       `json:"ciphertext_size"` // total size of the encrypted chunk payloads
+
+	EndMarker       bool  `json:"end_marker"`        // the stream ends with an end of stream marker
+	EndMarkerOffset int64 `json:"end_marker_offset"` // offset of the marker, if present
+	TrailingBytes   int64 `json:"trailing_bytes"`    // bytes following the marker
+	Size            int64 `json:"size"`              // total bytes read
+}
+
+// ChunkInfo describes one data chunk of an encrypted stream.
+type ChunkInfo struct {
+	Offset     int64 `json:"offset"`      // offset of the chunk header in the stream
+	HeaderSize int   `json:"header_size"` // size of the chunk header
+	NonceSize  int   `json:"nonce_size"`
+	Size       int   `json:"size"` // size of the encrypted payload
+}
+
+// Inspect reads an encrypted stream from `r` and reports its format and
+// chunk layout without a key: the header is parsed and the chunk headers are
+// walked, skipping over the encrypted payloads. Nothing is authenticated, so
+// the result describes what the stream claims to be, not that it is genuine.
+//
+// If the stream is malformed or ends before its end of stream marker, Inspect
+// returns what it found so far together with an error, wrapped in a
+// *StreamError, that locates the problem. Armored streams are decoded first.
+func Inspect(r io.Reader) (*StreamInfo, error) {
+	info := &StreamInfo{}
+	r, armored, err := dearmor(r)
+	if err != nil {
+		return info, streamError("inspect", 0, 0, err)
+	}
+	info.Armored = armored
+	cr := &countingReader{r: r}
+
+	h := header{}
+	if err := h.parse(cr); err != nil {
+		info.Size = cr.n
+		return info, streamError("inspect", 0, 0, err)
+	}
+	info.Scheme = strings.TrimRight(string(h.scheme[:]), "\x00")
+	info.Format = h.format()
+	info.HeaderSize = cr.n
+	if spec, err := lookupFormat(string(h.scheme[:]), h.format()); err == nil {
+		info.Supported = true
+		info.Deprecated = spec.deprecated
+		if spec.describe != nil {
+			spec.describe(&h, info)
+		}
+	}
+
+	fail := func(off int64, err error) (*StreamInfo, error) {
+		info.Size = cr.n
+		return info, streamError("inspect", info.ChunkCount+1, off, err)
+	}
+	for {
+		off := cr.n
+		ch, err := readChunkHeader(cr, nil, chunkSize*2)
+		if err != nil {
+			return fail(off, err)
+		}
+		hsize := int(cr.n - off)
+		if _, err := io.CopyN(io.Discard, cr, int64(ch.size)); err != nil {
+			return fail(off, truncated(err))
+		}
+		if ch.tomb {
+			info.EndMarker = true
+			info.EndMarkerOffset = off
+			break
+		}
+		info.Chunks = append(info.Chunks, ChunkInfo{
+			Offset:     off,
+			HeaderSize: hsize,
+			NonceSize:  len(ch.nonce),
+			Size:       int(ch.size),
+		})
+		info.ChunkCount++
+		info.CiphertextSize += int64(ch.size)
+	}
+
+	// count whatever follows the marker
+	n, err := io.Copy(io.Discard, cr)
+	info.TrailingBytes = n
+	info.Size = cr.n
+	if err != nil {
+		return fail(info.EndMarkerOffset, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,96 @@
+package cryptod
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	plaintext := generatePlainText(chunkSize*2 + 100)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, "secret key"); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	data := buf.Bytes()
+	chunks, header, tomb := parseEncryptedStream(t, data)
+
+	info, err := Inspect(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("inspect error: %v", err)
+	}
+	if info.Scheme != scheme || info.Format != FormatV2 || !info.Supported || info.Deprecated {
+		t.Errorf("unexpected format info: %+v", info)
+	}
+	if info.HeaderSize != int64(len(header)) {
+		t.Errorf("expected header size %d, got %d", len(header), info.HeaderSize)
+	}
+	if info.ChunkCount != uint64(len(chunks)) || len(info.Chunks) != len(chunks) {
+		t.Fatalf("expected %d chunks, got %d", len(chunks), info.ChunkCount)
+	}
+	off := int64(len(header))
+	for i, c := range info.Chunks {
+		if c.Offset != off || c.HeaderSize+c.Size != len(chunks[i]) {
+			t.Errorf("chunk %d: unexpected layout %+v", i+1, c)
+		}
+		off += int64(len(chunks[i]))
+	}
+	if !info.EndMarker || info.EndMarkerOffset != int64(len(data)-len(tomb)) {
+		t.Errorf("expected end marker at %d, got %v at %d", len(data)-len(tomb), info.EndMarker, info.EndMarkerOffset)
+	}
+	if info.Size != int64(len(data)) || info.TrailingBytes != 0 {
+		t.Errorf("unexpected size %d, trailing %d", info.Size, info.TrailingBytes)
+	}
+
+	// format is encoded as text in JSON
+	b, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded StreamInfo
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Format != FormatV2 || !bytes.Contains(b, []byte(`"format":"2.0"`)) {
+		t.Errorf("unexpected JSON format: %s", b)
+	}
+}
+
+func TestInspectDamaged(t *testing.T) {
+	plaintext := generatePlainText(chunkSize*2 + 100)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, "secret key"); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	data := buf.Bytes()
+	_, _, tomb := parseEncryptedStream(t, data)
+
+	// trailing data is counted, not an error
+	info, err := Inspect(bytes.NewReader(append(append([]byte(nil), data...), "extra"...)))
+	if err != nil || !info.EndMarker || info.TrailingBytes != 5 {
+		t.Errorf("trailing data: unexpected result %v, %+v", err, info)
+	}
+
+	// a missing end marker is reported along with what was found
+	info, err = Inspect(bytes.NewReader(data[:len(data)-len(tomb)]))
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("expected ErrTruncated, got %v", err)
+	}
+	if info.EndMarker || info.ChunkCount != 3 {
+		t.Errorf("truncated: unexpected info %+v", info)
+	}
+
+	// unknown formats can still be inspected
+	unknown := append([]byte(nil), data...)
+	unknown[12] = 9
+	info, err = Inspect(bytes.NewReader(unknown))
+	if err != nil || info.Supported || info.Format != (Format{Major: 9, Minor: 0}) {
+		t.Errorf("unknown format: unexpected result %v, %+v", err, info)
+	}
+
+	_, err = Inspect(bytes.NewReader(plaintext))
+	if !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected ErrBadHeader, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package cryptod
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Key holds the secret that streams are encrypted with. Unlike the string
+// keys taken by Encrypt and Decrypt, its memory can be wiped with Destroy, and
+// it never prints its bytes: fmt and log show it as "cryptod.Key{REDACTED}"
+// whatever the verb.
+//
+// What every stream derives from the key alone, such as the 32-byte master
+// key, is derived once and kept with the Key until Destroy wipes it, so
+// streams sharing a Key, like those of an Encryptor, do not repeat the work.
+//
+// A Key may be used by several goroutines at once, but must not be destroyed
+// while in use.
+type Key struct {
+	b         []byte
+	raw       bool // used as the AES key material as is, see NewRawKey
+	destroyed bool
+	derived   *derivedKeys // nil for a Key{} made outside the package
+}
+
+// derivedKeys caches what is derived from a Key, each part on first use.
+// It is behind a pointer so that copies of a Key made by fmt share it.
+type derivedKeys struct {
+	mu     sync.Mutex
+	master *[32]byte
+	gear   *[256]uint64 // see gearTable
+	v1     cipher.AEAD  // see getGCM
+}
+
+// newKey returns a Key holding `b`, which it takes ownership of
+func newKey(b []byte, raw bool) *Key {
+	return &Key{b: b, raw: raw, derived: &derivedKeys{}}
+}
+
+// RawKeySize is the size of raw keys.
+const RawKeySize = 32
+
+// NewKey returns a Key holding a copy of `b`. The bytes are used exactly like
+// the string keys of Encrypt, so NewKey([]byte(s)) decrypts streams encrypted
+// with `s`. Clear `b` once the Key is made.
+func NewKey(b []byte) *Key {
+	return newKey(append([]byte(nil), b...), false)
+}
+
+// NewRawKey returns a Key that uses `b`, which must be exactly RawKeySize
+// uniformly random bytes such as a key from a KMS, without hashing it first.
+// Streams record that they were encrypted with a raw key, and only a raw key
+// decrypts them, so passing the hex text of a key where its bytes were meant
+// fails instead of silently encrypting under a different key. Clear `b`
+// once the Key is made.
+func NewRawKey(b []byte) (*Key, error) {
+	if len(b) != RawKeySize {
+		return nil, fmt.Errorf("%w: raw keys are %d bytes, got %d", ErrInvalidKey, RawKeySize, len(b))
+	}
+	return newKey(append([]byte(nil), b...), true), nil
+}
+
+// GenerateKey returns a new random raw key.
+func GenerateKey() (*Key, error) {
+	k := newKey(make([]byte, RawKeySize), true)
+	if _, err := io.ReadFull(rand.Reader, k.b); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// passphraseKey returns a Key for the string key `skey`
+func passphraseKey(skey string) *Key {
+	return newKey([]byte(skey), false)
+}
+
+// Destroy overwrites the key material and the keys derived from it with
+// zeros. Using the Key afterwards fails with ErrKeyDestroyed.
+func (k *Key) Destroy() {
+	if k == nil {
+		return
+	}
+	clear(k.b)
+	k.b = nil
+	k.destroyed = true
+	if d := k.derived; d != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.master != nil {
+			clear(d.master[:])
+		}
+		if d.gear != nil {
+			clear(d.gear[:])
+		}
+		// the AES key schedule inside the cipher cannot be reached to clear
+		d.master, d.gear, d.v1 = nil, nil, nil
+	}
+}
+
+// check returns ErrKeyDestroyed if the key cannot be used
+func (k *Key) check() error {
+	if k == nil || k.destroyed {
+		return ErrKeyDestroyed
+	}
+	return nil
+}
+
+// master returns a copy of the 32-byte key that stream keys are derived
+// from, which the caller clears
+func (k *Key) master() [32]byte {
+	d := k.derived
+	if d == nil {
+		return k.deriveMaster()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.master == nil {
+		m := k.deriveMaster()
+		d.master = &m
+	}
+	return *d.master
+}
+
+func (k *Key) deriveMaster() [32]byte {
+	if k.raw {
+		return [32]byte(k.b)
+	}
+	return sha512.Sum512_256(k.b)
+}
+
+// cached returns the field of the cache of `k` selected by `field`, storing
+// the result of `derive` in it on first use. Keys without a cache derive it
+// every time.
+func cached[T comparable](k *Key, field func(*derivedKeys) *T, derive func() (T, error)) (T, error) {
+	d := k.derived
+	if d == nil {
+		return derive()
+	}
+	var zero T
+	d.mu.Lock()
+	v := *field(d)
+	d.mu.Unlock()
+	if v != zero {
+		return v, nil
+	}
+	// derived unlocked, since it may use the master key
+	v, err := derive()
+	if err != nil {
+		return zero, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if cur := *field(d); cur != zero {
+		return cur, nil
+	}
+	*field(d) = v
+	return v, nil
+}
+
+// Format implements fmt.Formatter so that no verb prints the key material.
+func (k Key) Format(f fmt.State, verb rune) {
+	io.WriteString(f, k.String())
+}
+
+// String implements fmt.Stringer without revealing the key.
+func (k Key) String() string {
+	return "cryptod.Key{REDACTED}"
+}
+
+// GoString implements fmt.GoStringer without revealing the key.
+func (k Key) GoString() string {
+	return k.String()
+}
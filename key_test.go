@@ -0,0 +1,259 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestKeyFormat(t *testing.T) {
+	const secret = "correct horse battery staple"
+	k := NewKey([]byte(secret))
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d"} {
+		for _, v := range []any{k, *k, []*Key{k}, struct{ K *Key }{k}} {
+			got := fmt.Sprintf(format, v)
+			if strings.Contains(got, secret) || strings.Contains(got, fmt.Sprintf("%x", secret)) {
+				t.Errorf("%s of %T reveals the key: %s", format, v, got)
+			}
+		}
+		if got := fmt.Sprintf(format, k); got != "cryptod.Key{REDACTED}" {
+			t.Errorf("%s: got %s", format, got)
+		}
+	}
+}
+
+func TestEncryptWithKey(t *testing.T) {
+	const secret = "this is a secret"
+	plaintext := generatePlainText(chunkSize + 100)
+	b := []byte(secret)
+	k := NewKey(b)
+	clear(b) // the key holds its own copy
+
+	for _, workers := range []int{1, 4} {
+		buf := &bytes.Buffer{}
+		if err := EncryptWithKey(bytes.NewReader(plaintext), buf, k, WithConcurrency(workers)); err != nil {
+			t.Fatalf("workers=%d: encrypt error: %v", workers, err)
+		}
+		// interchangeable with the string key
+		out := &bytes.Buffer{}
+		if err := Decrypt(bytes.NewReader(buf.Bytes()), out, secret); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+			t.Errorf("workers=%d: decrypt with string key: %v", workers, err)
+		}
+		out.Reset()
+		if err := DecryptWithKey(buf, out, k, WithConcurrency(workers)); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+			t.Errorf("workers=%d: decrypt with key: %v", workers, err)
+		}
+	}
+
+	material := k.b
+	k.Destroy()
+	if !bytes.Equal(material, make([]byte, len(secret))) {
+		t.Error("Destroy did not zero the key")
+	}
+	err := EncryptWithKey(bytes.NewReader(plaintext), io.Discard, k)
+	if !errors.Is(err, ErrKeyDestroyed) {
+		t.Errorf("encrypt: expected ErrKeyDestroyed, got %v", err)
+	}
+	if _, err := VerifyWithKey(bytes.NewReader(nil), k); !errors.Is(err, ErrKeyDestroyed) {
+		t.Errorf("verify: expected ErrKeyDestroyed, got %v", err)
+	}
+	k.Destroy() // twice is fine
+}
+
+// capturingReader records the buffers Encrypt reads plaintext into
+type capturingReader struct {
+	r    io.Reader
+	bufs [][]byte
+}
+
+func (c *capturingReader) Read(p []byte) (int, error) {
+	c.bufs = append(c.bufs, p)
+	return c.r.Read(p)
+}
+
+// capturingWriter records the buffers Decrypt writes plaintext from
+type capturingWriter struct {
+	bufs [][]byte
+}
+
+func (c *capturingWriter) Write(p []byte) (int, error) {
+	c.bufs = append(c.bufs, p)
+	return len(p), nil
+}
+
+func TestBuffersCleared(t *testing.T) {
+	const key = "this is a secret"
+	plaintext := bytes.Repeat([]byte{0xAA}, chunkSize*2+100)
+	zeroed := func(bufs [][]byte) bool {
+		for _, b := range bufs {
+			if bytes.IndexByte(b, 0xAA) >= 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, opts := range [][]Option{
+		{WithConcurrency(1)},
+		{WithConcurrency(4)},
+		{WithContentDefinedChunking(0, 0, 0)},
+	} {
+		cr := &capturingReader{r: bytes.NewReader(plaintext)}
+		buf := &bytes.Buffer{}
+		if err := Encrypt(cr, buf, key, opts...); err != nil {
+			t.Fatal(err)
+		}
+		if !zeroed(cr.bufs) {
+			t.Errorf("%d options: encrypt left plaintext in its buffers", len(opts))
+		}
+
+		cw := &capturingWriter{}
+		if err := Decrypt(buf, cw, key, opts...); err != nil {
+			t.Fatal(err)
+		}
+		if len(cw.bufs) == 0 || !zeroed(cw.bufs) {
+			t.Errorf("%d options: decrypt left plaintext in its buffers", len(opts))
+		}
+	}
+
+	// content-defined chunks of increasing size, the last larger than the
+	// decrypt buffers, which are replaced for it
+	data := sealChunks(t, NewKey([]byte(key)), []int{1000, 100 * 1024, chunkSize, chunkSize * 3 / 2}, WithContentDefinedChunking(0, 0, 0))
+	for _, workers := range []int{1, 4} {
+		cw := &capturingWriter{}
+		if err := Decrypt(bytes.NewReader(data), cw, key, WithConcurrency(workers)); err != nil {
+			t.Fatal(err)
+		}
+		if len(cw.bufs) != 4 || !zeroed(cw.bufs) {
+			t.Errorf("workers=%d: growing chunks left plaintext in replaced buffers", workers)
+		}
+	}
+}
+
+// sealChunks returns a stream of chunks of 0xAA bytes of the given sizes,
+// sealed one by one so that sizes Encrypt would not cut can be tested
+func sealChunks(t *testing.T, key *Key, sizes []int, opts ...Option) []byte {
+	t.Helper()
+	enc, err := newStreamEncoder(nil, key, newOptions(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := enc.header().write(buf); err != nil {
+		t.Fatal(err)
+	}
+	hbuf := make([]byte, 0, maxChunkHeaderSize)
+	for i, n := range sizes {
+		nonce := make([]byte, enc.nonceSize())
+		c, err := enc.seal(nil, nonce, bytes.Repeat([]byte{0xAA}, n), uint64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeChunk(buf, hbuf, nonce, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nonce := make([]byte, enc.nonceSize())
+	c, err := enc.sealTomb(nil, nonce, uint64(len(sizes)+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeChunkHeader(chunkHeader{nonce: nonce, size: uint32(len(c)), tomb: true}, buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(c)
+	return buf.Bytes()
+}
+
+func TestRawKey(t *testing.T) {
+	for _, n := range []int{0, 16, 31, 33, 64} {
+		if _, err := NewRawKey(make([]byte, n)); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("%d bytes: expected ErrInvalidKey, got %v", n, err)
+		}
+	}
+	k, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := generatePlainText(chunkSize + 100)
+	buf := &bytes.Buffer{}
+	if err := EncryptWithKey(bytes.NewReader(plaintext), buf, k); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if info, err := Inspect(bytes.NewReader(data)); err != nil || !info.RawKey {
+		t.Errorf("expected a raw key stream: %v, %+v", err, info)
+	}
+	out := &bytes.Buffer{}
+	if err := DecryptWithKey(bytes.NewReader(data), out, k); err != nil || !bytes.Equal(out.Bytes(), plaintext) {
+		t.Errorf("decrypt error: %v", err)
+	}
+
+	// the same bytes as a passphrase are a different key, either way round
+	if err := DecryptWithKey(bytes.NewReader(data), io.Discard, NewKey(k.b)); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("passphrase key: expected ErrWrongKey, got %v", err)
+	}
+	buf.Reset()
+	if err := EncryptWithKey(bytes.NewReader(plaintext), buf, NewKey(k.b)); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptWithKey(buf, io.Discard, k); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("raw key: expected ErrWrongKey, got %v", err)
+	}
+
+	if err := EncryptWithKey(bytes.NewReader(plaintext), io.Discard, k, WithFormat(FormatV1)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("format 1.0: expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	k, err := NewRawKey(bytes.Repeat([]byte{0x5A}, RawKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, enc := range []KeyEncoding{KeyHex, KeyBase64, KeyBech32} {
+		text, err := k.Encode(enc)
+		if err != nil {
+			t.Fatalf("%v: encode error: %v", enc, err)
+		}
+		got, err := DecodeKey(append(text, '\n'), enc)
+		if err != nil || !got.raw || !bytes.Equal(got.b, k.b) {
+			t.Errorf("%v: round trip failed: %v", enc, err)
+		}
+		if _, err := DecodeKey(text[:len(text)-4], enc); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("%v: truncated: expected ErrInvalidKey, got %v", enc, err)
+		}
+	}
+
+	text, _ := k.Encode(KeyBech32)
+	if !bytes.HasPrefix(text, []byte("cryptodkey1")) || len(text) != 69 {
+		t.Errorf("unexpected bech32 key %s", text)
+	}
+	if _, err := DecodeKey(bytes.ToUpper(text), KeyBech32); err != nil {
+		t.Errorf("upper case: %v", err)
+	}
+	for name, bad := range map[string][]byte{
+		"typo":       append(append([]byte(nil), text[:20]...), append([]byte{text[20] ^ 1}, text[21:]...)...),
+		"transposed": append(append([]byte(nil), text[:20]...), append([]byte{text[21], text[20]}, text[22:]...)...),
+		"mixed case": append(bytes.ToUpper(text[:20]), text[20:]...),
+		"prefix":     append([]byte("cryptodkex1"), text[11:]...),
+	} {
+		if _, err := DecodeKey(bad, KeyBech32); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("%s: expected ErrInvalidKey, got %v", name, err)
+		}
+	}
+	// BIP 350 test vectors
+	for _, s := range []string{"a1lqfn3a", "abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx"} {
+		sep := strings.LastIndexByte(s, '1')
+		if _, err := bech32Decode(s[:sep], []byte(s)); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+
+	if _, err := NewKey([]byte("passphrase")).Encode(KeyHex); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("passphrase key: expected ErrInvalidKey, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package cryptod
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// KeyEncoding selects the text form of a raw key, see Key.Encode and DecodeKey
+type KeyEncoding int
+
+const (
+	// KeyHex is lowercase hex, 64 characters.
+	KeyHex KeyEncoding = iota
+	// KeyBase64 is padded standard base64, 44 characters.
+	KeyBase64
+	// KeyBech32 is "cryptodkey1" followed by the key and a 6 character
+	// checksum in the bech32 alphabet, as in Bitcoin's bech32m addresses. The
+	// checksum catches mistyped or transposed characters, so it is the best
+	// choice for keys people copy by hand.
+	KeyBech32
+)
+
+func (e KeyEncoding) String() string {
+	switch e {
+	case KeyHex:
+		return "hex"
+	case KeyBase64:
+		return "base64"
+	case KeyBech32:
+		return "bech32"
+	}
+	return fmt.Sprintf("KeyEncoding(%d)", int(e))
+}
+
+// Encode returns the raw key `k` as text. Only raw keys can be encoded.
+// The result is a byte slice so it can be cleared after use.
+func (k *Key) Encode(enc KeyEncoding) ([]byte, error) {
+	if err := k.check(); err != nil {
+		return nil, err
+	}
+	if !k.raw {
+		return nil, fmt.Errorf("%w: only raw keys can be encoded", ErrInvalidKey)
+	}
+	switch enc {
+	case KeyHex:
+		return hex.AppendEncode(nil, k.b), nil
+	case KeyBase64:
+		return base64.StdEncoding.AppendEncode(nil, k.b), nil
+	case KeyBech32:
+		return bech32Encode(keyHRP, k.b), nil
+	}
+	return nil, fmt.Errorf("unknown key encoding %v", enc)
+}
+
+// DecodeKey returns the raw key encoded in `text` with `enc`. Surrounding
+// white space is ignored. Clear `text` once the Key is made.
+func DecodeKey(text []byte, enc KeyEncoding) (*Key, error) {
+	text = bytes.TrimSpace(text)
+	var b []byte
+	var err error
+	switch enc {
+	case KeyHex:
+		// the decoding errors of hex and base64 quote the offending
+		// character, which is part of the key
+		if b, err = hex.AppendDecode(nil, text); err != nil {
+			err = errors.New("malformed")
+		}
+	case KeyBase64:
+		if b, err = base64.StdEncoding.AppendDecode(nil, text); err != nil {
+			err = errors.New("malformed")
+		}
+	case KeyBech32:
+		b, err = bech32Decode(keyHRP, text)
+	default:
+		return nil, fmt.Errorf("unknown key encoding %v", enc)
+	}
+	defer clear(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v key: %v", ErrInvalidKey, enc, err)
+	}
+	return NewRawKey(b)
+}
+
+// keyHRP is the human-readable part of bech32 encoded keys
+const keyHRP = "cryptodkey"
+
+const (
+	bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	bech32mConst  = 0x2bc830a3
+)
+
+// bech32Polymod returns the BCH checksum state of `values` after `hrp`
+func bech32Polymod(hrp string, values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	step := func(v byte) {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range gen {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	for i := 0; i < len(hrp); i++ {
+		step(hrp[i] >> 5)
+	}
+	step(0)
+	for i := 0; i < len(hrp); i++ {
+		step(hrp[i] & 31)
+	}
+	for _, v := range values {
+		step(v)
+	}
+	return chk
+}
+
+// bech32Encode returns `data` encoded as bech32m with prefix `hrp`
+func bech32Encode(hrp string, data []byte) []byte {
+	values := make([]byte, 0, (len(data)*8+4)/5+6)
+	defer func() { clear(values) }()
+	var acc, n uint
+	for _, b := range data {
+		acc = acc<<8 | uint(b)
+		for n += 8; n >= 5; n -= 5 {
+			values = append(values, byte(acc>>(n-5))&31)
+		}
+	}
+	if n > 0 {
+		values = append(values, byte(acc<<(5-n))&31)
+	}
+	acc = 0
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	chk := bech32Polymod(hrp, values) ^ bech32mConst
+	for i := range 6 {
+		values[len(values)-6+i] = byte(chk>>(5*(5-i))) & 31
+	}
+
+	out := make([]byte, 0, len(hrp)+1+len(values))
+	out = append(append(out, hrp...), '1')
+	for _, v := range values {
+		out = append(out, bech32Charset[v])
+	}
+	return out
+}
+
+// bech32Decode returns the data of bech32m text `s` with prefix `hrp`
+func bech32Decode(hrp string, s []byte) ([]byte, error) {
+	if bytes.ContainsFunc(s, func(r rune) bool { return r >= 'a' && r <= 'z' }) &&
+		bytes.ContainsFunc(s, func(r rune) bool { return r >= 'A' && r <= 'Z' }) {
+		return nil, errors.New("mixed case")
+	}
+	s = bytes.ToLower(s)
+	defer clear(s)
+	sep := bytes.LastIndexByte(s, '1')
+	if sep < 0 || string(s[:sep]) != hrp {
+		return nil, fmt.Errorf("missing %q prefix", hrp+"1")
+	}
+	if len(s)-sep-1 < 6 {
+		return nil, errors.New("too short")
+	}
+	values := make([]byte, len(s)-sep-1)
+	defer clear(values)
+	for i, c := range s[sep+1:] {
+		v := bytes.IndexByte([]byte(bech32Charset), c)
+		if v < 0 {
+			return nil, fmt.Errorf("invalid character at %d", sep+1+i)
+		}
+		values[i] = byte(v)
+	}
+	if bech32Polymod(hrp, values) != bech32mConst {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	values = values[:len(values)-6]
+	data := make([]byte, 0, len(values)*5/8)
+	var acc, n uint
+	for _, v := range values {
+		acc = acc<<5 | uint(v)
+		if n += 5; n >= 8 {
+			n -= 8
+			data = append(data, byte(acc>>n))
+		}
+	}
+	if n >= 5 || acc&(1<<n-1) != 0 {
+		clear(data)
+		return nil, errors.New("invalid padding")
+	}
+	return data, nil
+}
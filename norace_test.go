@@ -0,0 +1,5 @@
+//go:build !race
+
+package cryptod
+
+const raceEnabled = false
@@ -0,0 +1,126 @@
+package cryptod
+
+// Option configures optional behaviour of Encrypt and Decrypt.
+type Option func(*options)
+
+type options struct {
+	concurrency int // number of workers sealing/opening chunks
+	inFlight    int // max chunks read ahead but not yet written
+
+	progress  func(Progress) // called after each chunk
+	totalSize int64          // size of the input, -1 to detect
+
+	allowTrailing bool // don't check for data after the end of stream
+
+	format        Format // format written by Encrypt
+	noDeprecated  bool   // refuse deprecated formats
+	keyCommitment bool   // refuse formats that do not commit to the key
+
+	zeroFill bool // Recover writes zeros for lost chunks
+
+	ad            []byte // associated data authenticated with every chunk
+	deterministic bool   // equal inputs give equal streams
+
+	chunking *chunking // content-defined chunk sizes, nil for fixed-size chunks
+
+	checkpoint func(*Checkpoint) error // called before each chunk
+
+	armor        bool   // Encrypt writes ASCII armor
+	armorComment string // header comment of the armor
+
+	bufs *bufferPool // recycles chunk buffers, nil to allocate them
+}
+
+// newOptions applies `opts` over the defaults
+func newOptions(opts []Option) *options {
+	o := &options{concurrency: 1, totalSize: -1, format: defaultFormat}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.concurrency < 1 {
+		o.concurrency = 1
+	}
+	if o.inFlight < 1 {
+		o.inFlight = o.concurrency * 2
+	}
+	return o
+}
+
+// WithConcurrency sets the number of goroutines used to encrypt or decrypt
+// chunks in parallel. Chunks are read ahead, sealed or opened on a pool of `n`
+// workers and written in their original order, so the output is the same as
+// sequential output. When decrypting, no plaintext of a chunk is written
+// before it and every earlier chunk have authenticated, and the first
+// authentication failure in stream order stops all workers and is the one
+// reported.
+//
+// A value of 1 or less (the default) processes chunks one at a time on the
+// calling goroutine.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+// WithChunksInFlight bounds memory use when running with WithConcurrency by
+// limiting the number of chunks that have been read but not yet written.
+// Each chunk in flight holds roughly 2MB of plaintext and ciphertext buffers.
+// The default is twice the concurrency.
+func WithChunksInFlight(n int) Option {
+	return func(o *options) {
+		o.inFlight = n
+	}
+}
+
+// WithTrailingData lets Decrypt return as soon as it reaches the end of stream
+// marker instead of checking that nothing follows it. Use it when the
+// encrypted stream is embedded in a longer one, e.g. a connection that stays
+// open; otherwise data after the marker is reported as ErrTrailingData.
+func WithTrailingData() Option {
+	return func(o *options) {
+		o.allowTrailing = true
+	}
+}
+
+// WithAssociatedData binds the stream to `ad`, e.g. a tenant ID and object
+// path. Encrypt authenticates `ad` with every chunk and the end of stream
+// marker but does not store it; Decrypt, Verify and Recover must be given the
+// same value, or the first chunk fails with ErrAuthentication. Absent and
+// empty associated data are the same. Format 1.0 does not support it.
+func WithAssociatedData(ad []byte) Option {
+	return func(o *options) {
+		o.ad = append([]byte(nil), ad...)
+	}
+}
+
+// WithDeterministic makes Encrypt deterministic: encrypting the same
+// plaintext with the same key and associated data always produces the same
+// stream, so storage that deduplicates by content can deduplicate encrypted
+// backups. Each chunk nonce is derived from a keyed hash of the chunk and its
+// position (a synthetic IV, as in AES-SIV) instead of a per-stream random
+// salt, and the mode is flagged in the stream header. Decrypt needs no option
+// to read such streams.
+//
+// Streams under the same key and associated data share their header, so a
+// chunk of one would open at the same position in another: only the end of
+// stream marker, which covers every chunk's position and nonce, detects a
+// chunk spliced in between such streams. For the same reason checkpoints
+// cannot be used.
+//
+// With WithContentDefinedChunking as well, a chunk's nonce and ciphertext
+// depend on its plaintext alone, not its position, so the chunks an edit
+// leaves alone are byte-identical in the new stream and deduplicate too.
+// Chunk order is then only authenticated by the end of stream marker.
+//
+// Use it only when that is the point. Anyone who can see the ciphertexts
+// learns which streams, and which chunks at the same position (or at any
+// position, with content-defined chunks), have equal plaintext under the
+// same key, and that streams share a key; a stream can also be replaced by
+// an older one under the same key and associated data without detection.
+// Bind each stream to its identity with WithAssociatedData to limit this.
+// Format 1.0 does not support it.
+func WithDeterministic() Option {
+	return func(o *options) {
+		o.deterministic = true
+	}
+}
@@ -0,0 +1,338 @@
+package cryptod
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// pipeSlot carries one job through the pipeline
+type pipeSlot[J any] struct {
+	job  J
+	err  error
+	done chan struct{} // receives once `err` is set
+}
+
+// runPipeline produces jobs on one goroutine, processes them on a pool of
+// `workers` goroutines and consumes them on the calling goroutine in the order
+// they were produced. At most `inFlight` jobs exist at once.
+//
+// Errors from `process` are reported by the consumer in production order, so
+// the error returned is always that of the earliest failing job; errors from
+// `produce` or `consume` cancel the other stages at once. runPipeline does
+// not return until every goroutine it started has exited.
+func runPipeline[J any](ctx context.Context, workers int, inFlight int,
+	produce func() (J, bool, error), process func(J) error, consume func(J) error) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	sem := make(chan struct{}, inFlight)
+	order := make(chan *pipeSlot[J], inFlight)
+	work := make(chan *pipeSlot[J], inFlight)
+	// slots are recycled once consumed; one whose job was abandoned after a
+	// failure may still be held by a worker, so it is left to the collector
+	free := make(chan *pipeSlot[J], inFlight)
+	var wg sync.WaitGroup
+
+	// workers
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range work {
+				if err := ctx.Err(); err != nil {
+					s.err = err
+				} else {
+					s.err = process(s.job)
+				}
+				s.done <- struct{}{}
+			}
+		}()
+	}
+
+	// producer
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(work)
+		defer close(order)
+		for {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			job, ok, err := produce()
+			if err != nil {
+				fail(err)
+				return
+			}
+			if !ok {
+				return
+			}
+			var s *pipeSlot[J]
+			select {
+			case s = <-free:
+			default:
+				s = &pipeSlot[J]{done: make(chan struct{}, 1)}
+			}
+			s.job, s.err = job, nil
+			// both channels have room for every job allowed by `sem`
+			order <- s
+			work <- s
+		}
+	}()
+
+	// consumer; keeps draining `order` after a failure so the producer never blocks
+	for s := range order {
+		if ctx.Err() != nil {
+			continue
+		}
+		select {
+		case <-s.done:
+			if s.err != nil {
+				fail(s.err)
+			} else if err := consume(s.job); err != nil {
+				fail(err)
+			}
+			var zero J
+			s.job = zero
+			free <- s
+		case <-ctx.Done():
+		}
+		<-sem
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		// cancelled by the caller's context
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// sealJob is a chunk being encrypted by encryptParallel
+type sealJob struct {
+	ctr    uint64
+	p      []byte // plaintext
+	nonce  []byte
+	cbuf   []byte
+	c      []byte // ciphertext
+	digest []byte // for checkpoints
+	err    error  // read or seal error, reported in order by the consumer
+}
+
+// encryptParallel encrypts the chunks of `src` on a pool of workers and writes
+// them to `w` in order.
+func encryptParallel(ctx context.Context, src chunker, w io.Writer, enc encoder, o *options, t *tracker, ck *checkpointer) error {
+	// recycle job buffers; at most o.inFlight jobs are alive at once
+	free := make(chan *sealJob, o.inFlight)
+	var jobs []*sealJob // every job, to clear their plaintext when done
+	getJob := func() *sealJob {
+		select {
+		case j := <-free:
+			return j
+		default:
+			pbuf := o.bufs.get(chunkSize)
+			j := &sealJob{
+				p:     pbuf,
+				nonce: make([]byte, enc.nonceSize()),
+				cbuf:  o.bufs.get(len(pbuf) + enc.overhead()),
+			}
+			jobs = append(jobs, j)
+			return j
+		}
+	}
+
+	ctr := t.chunks + 1
+	var readErr error
+	eof := false
+	hbuf := make([]byte, 0, maxChunkHeaderSize) // only used by the consumer
+
+	produce := func() (*sealJob, bool, error) {
+		if eof {
+			return nil, false, nil
+		}
+		j := getJob()
+		j.err = nil
+		for readErr == nil {
+			n, err := src.next(j.p[:cap(j.p)])
+			if err == io.EOF {
+				eof = true
+			} else {
+				readErr = err
+			}
+			if n > 0 {
+				j.p = j.p[:n]
+				j.ctr = ctr
+				ctr++
+				return j, true, nil
+			}
+			if eof {
+				free <- j
+				return nil, false, nil
+			}
+		}
+		// pass the read error down the pipeline so it is reported in order
+		eof = true
+		j.p = j.p[:0]
+		j.ctr = ctr
+		j.err = readErr
+		return j, true, nil
+	}
+
+	process := func(j *sealJob) error {
+		if j.err == nil {
+			j.digest = ck.digest(j.p)
+			j.c, j.err = enc.seal(j.cbuf, j.nonce, j.p, j.ctr)
+		}
+		return nil
+	}
+
+	consume := func(j *sealJob) error {
+		off := *t.cipher
+		if j.err != nil {
+			return streamError("encrypt", j.ctr, off, j.err)
+		}
+		if err := ck.save(j.ctr, t.plain, off, j.digest); err != nil {
+			return streamError("encrypt", j.ctr, off, err)
+		}
+		if err := writeChunk(w, hbuf, j.nonce, j.c); err != nil {
+			return streamError("encrypt", j.ctr, off, err)
+		}
+		t.chunk(len(j.p), *t.cipher)
+		free <- j
+		return nil
+	}
+
+	err := runPipeline(ctx, o.concurrency, o.inFlight, produce, process, consume)
+	for _, j := range jobs {
+		o.bufs.put(j.p[:cap(j.p)])
+		o.bufs.put(j.cbuf[:cap(j.cbuf)])
+	}
+	if err != nil && ctx.Err() != nil {
+		return streamError("encrypt", t.chunks+1, *t.cipher, cancelled("encrypt", t.plain, ctx.Err()))
+	}
+	return err
+}
+
+// openJob is a chunk being decrypted by decryptParallel
+type openJob struct {
+	ctr   uint64
+	nonce []byte // in hbuf
+	hbuf  []byte // chunk header
+	buf   []byte
+	c     []byte // ciphertext
+	p     []byte // plaintext, once authenticated
+	off   int64  // offset of the start of the chunk in the encrypted stream
+	end   int64  // offset of the end of the chunk in the encrypted stream
+	tomb  bool   // end of stream marker, authenticated in order after every chunk
+	err   error  // reading the chunk failed; reported in order
+}
+
+// decryptParallel reads chunks of `r` ahead, authenticates and decrypts them
+// on a pool of workers and writes the plaintext to `w` strictly in order.
+// Plaintext of a chunk is only written once it and every chunk before it
+// have authenticated; the first failure in stream order stops all workers. Plaintext is
+// discarded if `w` is nil.
+func decryptParallel(ctx context.Context, r io.Reader, w io.Writer, dec decoder, o *options, t *tracker, ck *checkpointer) error {
+	maxChunkSize := chunkSize + dec.overhead()
+
+	// recycle job buffers; at most o.inFlight jobs are alive at once
+	free := make(chan *openJob, o.inFlight)
+	var jobs []*openJob // every job, to clear their plaintext when done
+	getJob := func() *openJob {
+		select {
+		case j := <-free:
+			return j
+		default:
+			j := &openJob{hbuf: make([]byte, maxChunkHeaderSize), buf: o.bufs.get(maxChunkSize)}
+			jobs = append(jobs, j)
+			return j
+		}
+	}
+
+	ctr := t.chunks + 1
+	last := false // the tomb or a read error was produced
+
+	produce := func() (*openJob, bool, error) {
+		if last {
+			return nil, false, nil
+		}
+		j := getJob()
+		off := *t.cipher
+		j.ctr, j.off, j.err = ctr, off, nil
+		ch, cbuf, err := readChunk(r, j.hbuf, j.buf, maxChunkSize)
+		if err != nil {
+			// pass the read error down the pipeline so it is reported in
+			// order, after the chunks before it
+			last = true
+			j.tomb, j.p, j.err = false, nil, err
+			return j, true, nil
+		}
+		// tomb chunk header means we're done
+		last = ch.tomb
+		j.tomb = ch.tomb
+		j.buf = cbuf[:cap(cbuf)]
+		j.c = cbuf
+		j.nonce = ch.nonce
+		j.end = *t.cipher
+		ctr++
+		return j, true, nil
+	}
+
+	process := func(j *openJob) error {
+		if j.tomb || j.err != nil {
+			return nil
+		}
+		var err error
+		j.p, err = dec.open(j.c, j.nonce, j.ctr)
+		return streamError("decrypt", j.ctr, j.off, err)
+	}
+
+	var written int64 // end of the last chunk written
+	consume := func(j *openJob) error {
+		if j.err != nil {
+			return streamError("decrypt", j.ctr, j.off, j.err)
+		}
+		if j.tomb {
+			// opened in order, after every chunk: deterministic streams
+			// bind the order of their chunks at the end marker
+			return streamError("decrypt", j.ctr, j.off, dec.openTomb(j.c, j.nonce, j.ctr))
+		}
+		if w != nil {
+			if _, err := w.Write(j.p); err != nil {
+				return streamError("decrypt", j.ctr, j.off, err)
+			}
+		}
+		written = j.end
+		t.chunk(len(j.p), j.end)
+		if err := ck.save(j.ctr+1, j.end, t.plain, nil); err != nil {
+			return streamError("decrypt", j.ctr+1, j.end, err)
+		}
+		free <- j
+		return nil
+	}
+
+	err := runPipeline(ctx, o.concurrency, o.inFlight, produce, process, consume)
+	for _, j := range jobs {
+		o.bufs.put(j.buf[:cap(j.buf)])
+	}
+	if err != nil && ctx.Err() != nil {
+		return streamError("decrypt", t.chunks+1, written, cancelled("decrypt", t.plain, ctx.Err()))
+	}
+	return err
+}
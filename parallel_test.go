@@ -0,0 +1,280 @@
+package cryptod
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestEncryptParallel(t *testing.T) {
+	sizes := []int{0, 1, 1000, chunkSize, chunkSize + 1, chunkSize*7 + 13}
+	const key = "secret key"
+
+	for _, size := range sizes {
+		plaintext := generatePlainText(size)
+
+		seq := &bytes.Buffer{}
+		if err := Encrypt(bytes.NewReader(plaintext), seq, key); err != nil {
+			t.Fatalf("sequential encrypt error for size %d: %v", size, err)
+		}
+
+		par := &bytes.Buffer{}
+		if err := Encrypt(bytes.NewReader(plaintext), par, key, WithConcurrency(4), WithChunksInFlight(3)); err != nil {
+			t.Fatalf("parallel encrypt error for size %d: %v", size, err)
+		}
+
+		// same format: same header layout, same chunk layout, same total size
+		if seq.Len() != par.Len() {
+			t.Errorf("size %d: sequential output %d bytes, parallel %d bytes", size, seq.Len(), par.Len())
+		}
+		seqChunks, seqHeader, _ := parseEncryptedStream(t, seq.Bytes())
+		parChunks, parHeader, parTomb := parseEncryptedStream(t, par.Bytes())
+		// the fixed fields match; the stream salt differs
+		if len(seqHeader) != len(parHeader) || !bytes.Equal(seqHeader[:1+headerSize], parHeader[:1+headerSize]) {
+			t.Errorf("size %d: headers differ", size)
+		}
+		if len(seqChunks) != len(parChunks) {
+			t.Fatalf("size %d: sequential has %d chunks, parallel %d", size, len(seqChunks), len(parChunks))
+		}
+		for i := range seqChunks {
+			if len(seqChunks[i]) != len(parChunks[i]) {
+				t.Errorf("size %d: chunk %d length differs", size, i)
+			}
+		}
+		if parTomb == nil {
+			t.Errorf("size %d: parallel output missing tomb", size)
+		}
+
+		pbuf := &bytes.Buffer{}
+		if err := Decrypt(par, pbuf, key); err != nil {
+			t.Fatalf("decrypt error for size %d: %v", size, err)
+		}
+		if !bytes.Equal(plaintext, pbuf.Bytes()) {
+			t.Errorf("compare failed for size %d, bytes differ", size)
+		}
+	}
+}
+
+// TestEncryptParallelShortReads verifies chunks are full-sized however the reader delivers bytes
+func TestEncryptParallelShortReads(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize * 3)
+
+	buf := &bytes.Buffer{}
+	r := iotest.HalfReader(bytes.NewReader(plaintext))
+	if err := Encrypt(r, buf, key, WithConcurrency(3)); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	if chunks, _, _ := parseEncryptedStream(t, buf.Bytes()); len(chunks) != 3 {
+		t.Errorf("expected 3 chunks, got %d", len(chunks))
+	}
+
+	pbuf := &bytes.Buffer{}
+	if err := Decrypt(buf, pbuf, key); err != nil {
+		t.Fatalf("decrypt error: %v", err)
+	}
+	if !bytes.Equal(plaintext, pbuf.Bytes()) {
+		t.Error("decrypted data does not match original")
+	}
+}
+
+func TestEncryptParallelReadError(t *testing.T) {
+	errRead := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader(generatePlainText(chunkSize*2)), iotest.ErrReader(errRead))
+
+	before := runtime.NumGoroutine()
+	err := Encrypt(r, io.Discard, "secret key", WithConcurrency(4))
+	if !errors.Is(err, errRead) {
+		t.Fatalf("expected read error, got %v", err)
+	}
+	checkGoroutines(t, before)
+}
+
+// read errors are reported in stream order like authentication failures: the
+// chunks before the failed read are written, and an earlier bad chunk wins
+func TestDecryptParallelReadError(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize * 4)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	chunks, header, _ := parseEncryptedStream(t, data)
+	cut := len(header) + len(chunks[0]) + len(chunks[1]) + 100 // inside chunk 3
+	errRead := errors.New("read failed")
+
+	before := runtime.NumGoroutine()
+	out := &bytes.Buffer{}
+	r := io.MultiReader(bytes.NewReader(data[:cut]), iotest.ErrReader(errRead))
+	err := Decrypt(r, out, key, WithConcurrency(4))
+	var se *StreamError
+	if !errors.Is(err, errRead) || !errors.As(err, &se) || se.Chunk != 3 {
+		t.Errorf("expected read error in chunk 3, got %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), plaintext[:chunkSize*2]) {
+		t.Errorf("wrote %d bytes, expected the %d of the chunks before the error", out.Len(), chunkSize*2)
+	}
+
+	damaged := append([]byte(nil), data[:cut]...)
+	damaged[len(header)+len(chunks[0])+100] ^= 1
+	r = io.MultiReader(bytes.NewReader(damaged), iotest.ErrReader(errRead))
+	if err := Decrypt(r, io.Discard, key, WithConcurrency(4)); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("expected the authentication failure of chunk 2, got %v", err)
+	}
+	checkGoroutines(t, before)
+}
+
+func TestEncryptParallelWriteError(t *testing.T) {
+	// allow the header and first chunk through, then fail
+	w := &failingWriter{remaining: 3}
+
+	before := runtime.NumGoroutine()
+	err := Encrypt(bytes.NewReader(generatePlainText(chunkSize*8)), w, "secret key", WithConcurrency(4))
+	if !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("expected write error, got %v", err)
+	}
+	checkGoroutines(t, before)
+}
+
+func TestEncryptParallelCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := &cancelReader{r: bytes.NewReader(generatePlainText(chunkSize * 8)), cancel: cancel}
+
+	before := runtime.NumGoroutine()
+	err := EncryptContext(ctx, r, io.Discard, "secret key", WithConcurrency(4))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	checkGoroutines(t, before)
+}
+
+// failingWriter accepts `remaining` writes and then returns io.ErrShortWrite
+type failingWriter struct {
+	remaining int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.remaining <= 0 {
+		return 0, io.ErrShortWrite
+	}
+	f.remaining--
+	return len(p), nil
+}
+
+// checkGoroutines fails if more goroutines are running than `before`
+func checkGoroutines(t *testing.T, before int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine leak: %d before, %d after", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDecryptParallel(t *testing.T) {
+	sizes := []int{0, 1, 1000, chunkSize, chunkSize + 1, chunkSize*7 + 13}
+	const key = "secret key"
+
+	for _, size := range sizes {
+		plaintext := generatePlainText(size)
+
+		buf := &bytes.Buffer{}
+		if err := Encrypt(bytes.NewReader(plaintext), buf, key); err != nil {
+			t.Fatalf("encrypt error for size %d: %v", size, err)
+		}
+
+		pbuf := &bytes.Buffer{}
+		if err := Decrypt(buf, pbuf, key, WithConcurrency(4), WithChunksInFlight(3)); err != nil {
+			t.Fatalf("parallel decrypt error for size %d: %v", size, err)
+		}
+		if !bytes.Equal(plaintext, pbuf.Bytes()) {
+			t.Errorf("compare failed for size %d, bytes differ", size)
+		}
+	}
+}
+
+// TestDecryptParallelTamper verifies nothing from or after a failing chunk is written
+func TestDecryptParallelTamper(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize * 8)
+
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+
+	// corrupt the ciphertext of the 4th chunk
+	chunks, _, _ := parseEncryptedStream(t, buf.Bytes())
+	chunks[3][len(chunks[3])-1]++
+
+	before := runtime.NumGoroutine()
+	pbuf := &bytes.Buffer{}
+	err := Decrypt(bytes.NewReader(buf.Bytes()), pbuf, key, WithConcurrency(8))
+	if err == nil {
+		t.Fatal("expected a decrypt error with tampered chunk")
+	}
+	checkGoroutines(t, before)
+
+	if pbuf.Len() > chunkSize*3 {
+		t.Errorf("plaintext from tampered or later chunks was written: %d bytes", pbuf.Len())
+	}
+	if !bytes.Equal(plaintext[:pbuf.Len()], pbuf.Bytes()) {
+		t.Error("written plaintext does not match original")
+	}
+}
+
+// TestDecryptParallelReordering verifies chunk sequence is still enforced
+func TestDecryptParallelReordering(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize * 3)
+
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+
+	chunks, header, tomb := parseEncryptedStream(t, buf.Bytes())
+	reordered := &bytes.Buffer{}
+	reordered.Write(header)
+	reordered.Write(chunks[0])
+	reordered.Write(chunks[2])
+	reordered.Write(chunks[1])
+	reordered.Write(tomb)
+
+	pbuf := &bytes.Buffer{}
+	if err := Decrypt(reordered, pbuf, key, WithConcurrency(4)); err == nil {
+		t.Error("expected a decrypt error with reordered chunks")
+	}
+	if pbuf.Len() > chunkSize {
+		t.Errorf("plaintext after the reordered chunk was written: %d bytes", pbuf.Len())
+	}
+}
+
+func TestDecryptParallelCancel(t *testing.T) {
+	const key = "secret key"
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(generatePlainText(chunkSize*8)), buf, key); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	before := runtime.NumGoroutine()
+	w := &cancelWriter{cancel: cancel}
+	err := DecryptContext(ctx, buf, w, key, WithConcurrency(4))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	checkGoroutines(t, before)
+}
@@ -0,0 +1,148 @@
+package cryptod
+
+import (
+	"io"
+	"os"
+)
+
+// Progress reports how far an Encrypt or Decrypt has got. It is passed to the
+// hook installed with WithProgress.
+type Progress struct {
+	Chunk           uint64 // number of chunks processed so far
+	PlaintextBytes  int64  // plaintext bytes read (encrypt) or written (decrypt)
+	CiphertextBytes int64  // encrypted stream bytes written (encrypt) or read (decrypt)
+	TotalBytes      int64  // size of the input stream when known, otherwise -1
+	Done            bool   // true once the end of the stream has been processed
+
+	decrypt bool
+}
+
+// Fraction returns the fraction of the input processed so far, between 0 and 1,
+// or -1 if the total size of the input is unknown.
+func (p Progress) Fraction() float64 {
+	if p.TotalBytes < 0 {
+		return -1
+	}
+	if p.Done || p.TotalBytes == 0 {
+		return 1
+	}
+	n := p.PlaintextBytes
+	if p.decrypt {
+		n = p.CiphertextBytes
+	}
+	f := float64(n) / float64(p.TotalBytes)
+	if f > 1 {
+		f = 1
+	}
+	return f
+}
+
+// WithProgress installs a hook called after each chunk is written, and once
+// more when the end of the stream has been processed. The hook runs on the
+// goroutine writing the output, in chunk order, so it should return quickly.
+func WithProgress(fn func(Progress)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithTotalSize sets the size of the input stream reported in Progress: the
+// plaintext size when encrypting, or the encrypted stream size when
+// decrypting. Without it the size is detected for readers such as *os.File
+// and *bytes.Reader, and reported as -1 otherwise.
+func WithTotalSize(n int64) Option {
+	return func(o *options) {
+		o.totalSize = n
+	}
+}
+
+// tracker counts progress through a stream and reports it to the progress hook
+type tracker struct {
+	fn      func(Progress)
+	total   int64
+	decrypt bool
+	chunks  uint64
+	plain   int64
+	cipher  *int64 // bytes through the encrypted side of the stream
+}
+
+// newTracker creates a tracker for a stream reading from `r`, counting
+// encrypted bytes in `cipher`.
+func newTracker(o *options, r io.Reader, decrypt bool, cipher *int64) *tracker {
+	t := &tracker{fn: o.progress, total: o.totalSize, decrypt: decrypt, cipher: cipher}
+	if t.fn != nil && t.total < 0 {
+		t.total = inputSize(r)
+	}
+	return t
+}
+
+// chunk records a chunk of `n` plaintext bytes ending at offset `end` of the
+// encrypted stream
+func (t *tracker) chunk(n int, end int64) {
+	t.chunks++
+	t.plain += int64(n)
+	if t.fn != nil {
+		t.fn(t.progress(end, false))
+	}
+}
+
+// done records the end of the stream
+func (t *tracker) done() {
+	if t.fn != nil {
+		t.fn(t.progress(*t.cipher, true))
+	}
+}
+
+func (t *tracker) progress(cipher int64, done bool) Progress {
+	return Progress{
+		Chunk:           t.chunks,
+		PlaintextBytes:  t.plain,
+		CiphertextBytes: cipher,
+		TotalBytes:      t.total,
+		Done:            done,
+		decrypt:         t.decrypt,
+	}
+}
+
+// inputSize returns the number of bytes remaining in `r`, or -1 if unknown
+func inputSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *os.File:
+		fi, err := v.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - pos
+	}
+	return -1
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
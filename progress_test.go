@@ -0,0 +1,110 @@
+package cryptod
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	const key = "secret key"
+	size := chunkSize*3 + 17
+	plaintext := generatePlainText(size)
+
+	for _, workers := range []int{1, 4} {
+		var reports []Progress
+		buf := &bytes.Buffer{}
+		hook := WithProgress(func(p Progress) { reports = append(reports, p) })
+		if err := Encrypt(bytes.NewReader(plaintext), buf, key, hook, WithConcurrency(workers)); err != nil {
+			t.Fatalf("encrypt error: %v", err)
+		}
+		checkProgress(t, reports, 4, int64(size), int64(size), int64(buf.Len()))
+
+		reports = nil
+		total := int64(buf.Len())
+		if err := Decrypt(buf, io.Discard, key, hook, WithConcurrency(workers)); err != nil {
+			t.Fatalf("decrypt error: %v", err)
+		}
+		checkProgress(t, reports, 4, total, int64(size), total)
+	}
+}
+
+func TestProgressUnknownSize(t *testing.T) {
+	var last Progress
+	hook := WithProgress(func(p Progress) { last = p })
+
+	// io.LimitReader hides the size of the underlying reader
+	r := io.LimitReader(bytes.NewReader(generatePlainText(1000)), 1000)
+	if err := Encrypt(r, io.Discard, "secret key", hook); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	if last.TotalBytes != -1 {
+		t.Errorf("expected unknown total, got %d", last.TotalBytes)
+	}
+	if last.Fraction() != -1 {
+		t.Errorf("expected fraction -1, got %f", last.Fraction())
+	}
+
+	// explicit size wins
+	r = io.LimitReader(bytes.NewReader(generatePlainText(1000)), 1000)
+	if err := Encrypt(r, io.Discard, "secret key", hook, WithTotalSize(1000)); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	if last.TotalBytes != 1000 {
+		t.Errorf("expected total 1000, got %d", last.TotalBytes)
+	}
+}
+
+func TestProgressFileSize(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "plain.txt")
+	if err := os.WriteFile(fname, generatePlainText(5000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// only the remainder of the file counts
+	if _, err := f.Seek(1000, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n := inputSize(f); n != 4000 {
+		t.Errorf("expected input size 4000, got %d", n)
+	}
+}
+
+// checkProgress verifies a sequence of progress reports
+func checkProgress(t *testing.T, reports []Progress, chunks int, total, plain, cipher int64) {
+	t.Helper()
+	if len(reports) != chunks+1 {
+		t.Fatalf("expected %d progress reports, got %d", chunks+1, len(reports))
+	}
+	for i, p := range reports[:chunks] {
+		if p.Chunk != uint64(i+1) {
+			t.Errorf("report %d: expected chunk %d, got %d", i, i+1, p.Chunk)
+		}
+		if p.Done {
+			t.Errorf("report %d: unexpected done", i)
+		}
+		if i > 0 && (p.PlaintextBytes <= reports[i-1].PlaintextBytes || p.CiphertextBytes <= reports[i-1].CiphertextBytes) {
+			t.Errorf("report %d: byte counts did not increase", i)
+		}
+		if f := p.Fraction(); f <= 0 || f > 1 {
+			t.Errorf("report %d: fraction out of range: %f", i, f)
+		}
+	}
+	last := reports[chunks]
+	if !last.Done || last.Chunk != uint64(chunks) {
+		t.Errorf("final report: expected done after %d chunks, got %+v", chunks, last)
+	}
+	if last.TotalBytes != total || last.PlaintextBytes != plain || last.CiphertextBytes != cipher {
+		t.Errorf("final report: expected total=%d plain=%d cipher=%d, got %+v", total, plain, cipher, last)
+	}
+	if last.Fraction() != 1 {
+		t.Errorf("final report: expected fraction 1, got %f", last.Fraction())
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package cryptod
+
+// raceEnabled reports whether tests run with the race detector, under which
+// sync.Pool drops items at random
+const raceEnabled = true
@@ -0,0 +1,350 @@
+package cryptod
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// LostRange describes a damaged region skipped by Recover.
+type LostRange struct {
+	Offset     int64  // offset in the encrypted stream of the first damaged byte
+	Size       int64  // number of encrypted bytes skipped
+	FirstChunk uint64 // 1-based index of the first lost chunk
+	Chunks     uint64 // number of chunks lost; 0 if the region held none in sequence, or ran to the end of the input
+
+	PlaintextOffset int64 // offset in the plaintext where the lost data belonged
+	PlaintextSize   int64 // size of the lost plaintext, -1 if unknown
+}
+
+// RecoveryReport summarizes what Recover salvaged.
+type RecoveryReport struct {
+	Format         Format
+	Chunks         uint64      // chunks recovered
+	PlaintextBytes int64       // bytes written, including any zero fill
+	Lost           []LostRange // damaged regions, in stream order
+	EndMarker      bool        // the end of stream marker was found
+}
+
+// Intact reports whether the whole stream was recovered: nothing was lost
+// and the end of stream marker was found.
+func (rr *RecoveryReport) Intact() bool {
+	return len(rr.Lost) == 0 && rr.EndMarker
+}
+
+// WithZeroFill makes Recover write zeros in place of lost chunks whose size
+// is known, so the recovered data keeps its original offsets. Lost data at the
+// end of the stream, or in a stream with content-defined chunks, is never
+// filled.
+func WithZeroFill() Option {
+	return func(o *options) {
+		o.zeroFill = true
+	}
+}
+
+// Recover salvages what it can from a damaged encrypted stream. Unlike
+// Decrypt, which stops at the first chunk that fails authentication, Recover
+// skips damaged chunks, scans forward for the next chunk tag, and carries on
+// with the chunk counter recorded in the next good chunk. Every chunk it
+// writes has authenticated, and chunks are never accepted out of order, so
+// recovered data is genuine; only whole chunks can be missing. The exception
+// is deterministic streams, whose chunks may come from another stream under
+// the same key, or with content-defined chunks from any position: that is
+// only checked by the end of stream marker, which is reported as found only
+// if every chunk before it was recovered in order.
+//
+// Damaged regions are listed in the report rather than returned as errors.
+// Recover returns an error only when it cannot continue: the stream header is
+// unreadable, or reading or writing fails. Use the report's Intact method to
+// tell whether anything was lost.
+//
+// Armored input is detected as by Decrypt, and offsets are those of the
+// binary stream inside it. Armor that is cut short or malformed ends the
+// stream there: the chunks before the damage are recovered and the rest is
+// reported lost.
+//
+// Recover processes chunks one at a time; WithConcurrency is ignored.
+func Recover(r io.Reader, w io.Writer, skey string, opts ...Option) (*RecoveryReport, error) {
+	key := passphraseKey(skey)
+	defer key.Destroy()
+	return RecoverWithKey(r, w, key, opts...)
+}
+
+// RecoverWithKey is like Recover but takes the key as a Key.
+func RecoverWithKey(r io.Reader, w io.Writer, key *Key, opts ...Option) (*RecoveryReport, error) {
+	o := newOptions(opts)
+	report := &RecoveryReport{}
+	if err := key.check(); err != nil {
+		return report, streamError("recover", 0, 0, err)
+	}
+
+	// read the binary stream out of armor, as far as the armor is intact
+	r, armored, err := dearmor(r)
+	if err != nil {
+		return report, streamError("recover", 0, 0, err)
+	}
+	if armored {
+		r = &damagedArmorReader{r: r}
+	}
+
+	cr := &countingReader{r: r}
+	h := &header{}
+	if err := h.read(cr); err != nil {
+		return report, streamError("recover", 0, 0, err)
+	}
+	report.Format = h.format()
+	dec, err := newStreamDecoder(h, key, o)
+	if err != nil {
+		return report, streamError("recover", 0, 0, err)
+	}
+
+	rec := &recovery{
+		dec:          dec,
+		o:            o,
+		w:            w,
+		report:       report,
+		br:           bufio.NewReaderSize(cr, chunkSize+dec.overhead()+maxChunkHeaderSize),
+		pos:          cr.n,
+		headerSize:   cr.n,
+		ctr:          1,
+		maxChunkSize: chunkSize + dec.overhead(),
+	}
+	rec.work = make([]byte, rec.maxChunkSize)
+	defer func() { clear(rec.work) }()
+	return report, rec.run()
+}
+
+// damagedArmorReader ends the stream where armor is cut short or malformed,
+// so Recover salvages the chunks before the damage and reports the rest lost
+type damagedArmorReader struct {
+	r io.Reader
+}
+
+func (d *damagedArmorReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if errors.Is(err, ErrTruncated) || errors.Is(err, ErrBadArmor) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// recovery holds the state of a Recover run
+type recovery struct {
+	dec    decoder
+	o      *options
+	w      io.Writer
+	report *RecoveryReport
+	br     *bufio.Reader
+
+	pos          int64  // offset in the encrypted stream
+	headerSize   int64  // size of the stream header
+	ctr          uint64 // next expected chunk counter
+	plain        int64  // plaintext bytes written
+	maxChunkSize int
+	work         []byte     // scratch buffer for opening chunks
+	lost         *LostRange // damaged region being skipped
+}
+
+func (rec *recovery) run() error {
+	for {
+		done, ok, err := rec.next()
+		if err != nil {
+			return streamError("recover", rec.ctr, rec.pos, err)
+		}
+		if done {
+			break
+		}
+		if !ok {
+			// damaged; skip to the next chunk tag
+			rec.startLost()
+			if err := rec.resync(); err != nil {
+				return streamError("recover", rec.ctr, rec.pos, err)
+			}
+		}
+	}
+	if rec.lost != nil {
+		return rec.endLost(0, false)
+	}
+	return nil
+}
+
+// next tries to recover the chunk at the current position. It returns done
+// once the end of stream marker or the end of the input is reached, and ok
+// if a chunk was recovered.
+func (rec *recovery) next() (done bool, ok bool, err error) {
+	buf, err := rec.br.Peek(rec.br.Size())
+	if len(buf) == 0 {
+		if err == io.EOF {
+			return true, false, nil
+		}
+		return false, false, err
+	}
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return false, false, err
+	}
+
+	br := bytes.NewReader(buf)
+	ch, err := readChunkHeader(br, nil, rec.maxChunkSize)
+	if err != nil {
+		return false, false, nil
+	}
+	hsize := len(buf) - br.Len()
+	if br.Len() < int(ch.size) {
+		return false, false, nil
+	}
+	payload := buf[hsize : hsize+int(ch.size)]
+
+	for _, ctr := range rec.candidates(ch.nonce, hsize, ch.tomb) {
+		if ch.tomb {
+			if rec.dec.openTomb(payload, ch.nonce, ctr) != nil {
+				continue
+			}
+			if rec.lost != nil {
+				// the last lost chunk may have been short
+				if err := rec.endLost(ctr, false); err != nil {
+					return false, false, err
+				}
+			}
+			rec.report.EndMarker = true
+			rec.pos += int64(hsize + len(payload))
+			return true, true, nil
+		}
+		// opening in place clears the buffer on failure, so work on a copy
+		c := append(rec.work[:0], payload...)
+		p, err := rec.dec.open(c, ch.nonce, ctr)
+		if err != nil {
+			continue
+		}
+		if ctr > rec.ctr {
+			// chunks are missing without damaged bytes, e.g. cut out
+			rec.startLost()
+		}
+		if rec.lost != nil {
+			if err := rec.endLost(ctr, true); err != nil {
+				return false, false, err
+			}
+		}
+		if _, err := rec.w.Write(p); err != nil {
+			return false, false, err
+		}
+		rec.plain += int64(len(p))
+		rec.report.PlaintextBytes = rec.plain
+		rec.report.Chunks++
+		rec.ctr = ctr + 1
+		if _, err := rec.br.Discard(hsize + len(payload)); err != nil {
+			return false, false, err
+		}
+		rec.pos += int64(hsize + len(payload))
+		return false, true, nil
+	}
+	return false, false, nil
+}
+
+// candidates returns the chunk counters to try for a chunk at the current
+// position: the counter recorded in its nonce, the next expected counter,
+// and the counter implied by its offset if every chunk before it is full.
+// Counters before the expected one are never tried, so chunks cannot be
+// replayed or reordered.
+func (rec *recovery) candidates(nonce []byte, hsize int, tomb bool) []uint64 {
+	var ctrs []uint64
+	add := func(ctr uint64) {
+		if ctr < rec.ctr {
+			return
+		}
+		for _, c := range ctrs {
+			if c == ctr {
+				return
+			}
+		}
+		ctrs = append(ctrs, ctr)
+	}
+	if tomb {
+		add(rec.ctr)
+	}
+	if ctr, ok := rec.dec.counter(nonce); ok {
+		add(ctr)
+	}
+	add(rec.ctr)
+	stride := int64(hsize + rec.maxChunkSize)
+	if off := rec.pos - rec.headerSize; off%stride == 0 {
+		add(uint64(off/stride) + 1)
+	}
+	return ctrs
+}
+
+// resync skips forward to the next chunk tag after the current position
+func (rec *recovery) resync() error {
+	if _, err := rec.br.Discard(1); err != nil {
+		return err
+	}
+	rec.pos++
+	for {
+		buf, err := rec.br.Peek(rec.br.Size())
+		if len(buf) == 0 {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if i := bytes.Index(buf, []byte(chunkTag)); i >= 0 {
+			_, err = rec.br.Discard(i)
+			rec.pos += int64(i)
+			return err
+		}
+		// keep the last byte in case it starts a tag
+		n := len(buf) - 1
+		if n == 0 {
+			n = 1
+		}
+		if _, err := rec.br.Discard(n); err != nil {
+			return err
+		}
+		rec.pos += int64(n)
+	}
+}
+
+// startLost starts a damaged region at the current position, unless one is
+// already open
+func (rec *recovery) startLost() {
+	if rec.lost != nil {
+		return
+	}
+	rec.lost = &LostRange{
+		Offset:          rec.pos,
+		FirstChunk:      rec.ctr,
+		PlaintextOffset: rec.plain,
+		PlaintextSize:   -1,
+	}
+}
+
+// endLost closes the damaged region at the current position, where the
+// chunk or end marker with counter `ctr` was found, or the input ended if
+// `ctr` is 0. `full` says the lost chunks are known to be full-sized, unless
+// the stream has content-defined chunks, in which case the gap is filled with
+// zeros if asked.
+func (rec *recovery) endLost(ctr uint64, full bool) error {
+	lost := rec.lost
+	rec.lost = nil
+	lost.Size = rec.pos - lost.Offset
+	if ctr > 0 {
+		lost.Chunks = ctr - lost.FirstChunk
+		if full && !rec.dec.variableChunks() {
+			// every chunk but the last is full-sized
+			lost.PlaintextSize = int64(lost.Chunks) * chunkSize
+		}
+	}
+	rec.report.Lost = append(rec.report.Lost, *lost)
+
+	if rec.o.zeroFill && lost.PlaintextSize > 0 {
+		zeros := make([]byte, chunkSize)
+		for i := uint64(0); i < lost.Chunks; i++ {
+			if _, err := rec.w.Write(zeros); err != nil {
+				return err
+			}
+		}
+		rec.plain += lost.PlaintextSize
+		rec.report.PlaintextBytes = rec.plain
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRecover(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize*3 + 100)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	good := buf.Bytes()
+	chunks, header, tomb := parseEncryptedStream(t, good)
+
+	chunkOffset := func(n int) int {
+		off := len(header)
+		for _, c := range chunks[:n-1] {
+			off += len(c)
+		}
+		return off
+	}
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), good...))
+	}
+	// plaintext with chunk `n` (1-based) missing, or zeroed
+	without := func(n int, zero bool) []byte {
+		p := append([]byte(nil), plaintext[:(n-1)*chunkSize]...)
+		if zero {
+			p = append(p, make([]byte, chunkSize)...)
+		}
+		return append(p, plaintext[n*chunkSize:]...)
+	}
+	c2 := chunkOffset(2)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		zeroFill bool
+		want     []byte
+		lost     []LostRange
+		marker   bool
+	}{
+		{"intact", good, false, plaintext, nil, true},
+		{"corrupt chunk data", modify(func(b []byte) []byte { b[c2+100]++; return b }), false,
+			without(2, false), []LostRange{{int64(c2), int64(len(chunks[1])), 2, 1, chunkSize, chunkSize}}, true},
+		{"corrupt chunk data, zero fill", modify(func(b []byte) []byte { b[c2+100]++; return b }), true,
+			without(2, true), []LostRange{{int64(c2), int64(len(chunks[1])), 2, 1, chunkSize, chunkSize}}, true},
+		{"corrupt chunk tag", modify(func(b []byte) []byte { b[c2] = 'x'; return b }), true,
+			without(2, true), []LostRange{{int64(c2), int64(len(chunks[1])), 2, 1, chunkSize, chunkSize}}, true},
+		{"bytes missing from chunk", modify(func(b []byte) []byte { return append(b[:c2+500], b[c2+600:]...) }), true,
+			without(2, true), []LostRange{{int64(c2), int64(len(chunks[1]) - 100), 2, 1, chunkSize, chunkSize}}, true},
+		{"chunks swapped", modify(func(b []byte) []byte {
+			s := append(append([]byte(nil), chunks[2]...), chunks[1]...)
+			copy(b[c2:], s)
+			return b
+		}), false,
+			append(append(append([]byte(nil), plaintext[:chunkSize]...), plaintext[2*chunkSize:3*chunkSize]...), plaintext[3*chunkSize:]...),
+			[]LostRange{{int64(c2), 0, 2, 1, chunkSize, chunkSize}, {int64(chunkOffset(3)), int64(len(chunks[1])), 4, 0, 2 * chunkSize, 0}}, true},
+		{"truncated", good[:chunkOffset(3)+100], true,
+			plaintext[:2*chunkSize], []LostRange{{int64(chunkOffset(3)), 100, 3, 0, 2 * chunkSize, -1}}, false},
+		{"missing tomb", good[:len(good)-len(tomb)], false, plaintext, nil, false},
+	}
+
+	for _, tt := range tests {
+		out := &bytes.Buffer{}
+		var opts []Option
+		if tt.zeroFill {
+			opts = append(opts, WithZeroFill())
+		}
+		report, err := Recover(bytes.NewReader(tt.data), out, key, opts...)
+		if err != nil {
+			t.Errorf("%s: recover error: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), tt.want) {
+			t.Errorf("%s: recovered %d bytes, expected %d", tt.name, out.Len(), len(tt.want))
+		}
+		if report.PlaintextBytes != int64(len(tt.want)) {
+			t.Errorf("%s: report has %d plaintext bytes, expected %d", tt.name, report.PlaintextBytes, len(tt.want))
+		}
+		if len(report.Lost) != len(tt.lost) {
+			t.Errorf("%s: expected lost ranges %+v, got %+v", tt.name, tt.lost, report.Lost)
+		} else {
+			for i := range tt.lost {
+				if report.Lost[i] != tt.lost[i] {
+					t.Errorf("%s: expected lost range %+v, got %+v", tt.name, tt.lost[i], report.Lost[i])
+				}
+			}
+		}
+		if report.EndMarker != tt.marker || report.Intact() != (tt.marker && len(tt.lost) == 0) {
+			t.Errorf("%s: unexpected end marker %v, intact %v", tt.name, report.EndMarker, report.Intact())
+		}
+	}
+}
+
+func TestRecoverBadHeader(t *testing.T) {
+	_, err := Recover(bytes.NewReader([]byte("not encrypted at all")), &bytes.Buffer{}, "key")
+	if !errors.Is(err, ErrBadHeader) {
+		t.Errorf("expected ErrBadHeader, got %v", err)
+	}
+}
@@ -0,0 +1,490 @@
+package cryptod
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A repository directory holds:
+//
+//	config            encrypted repository settings, checked on open
+//	chunks/ab/abcd…   one encrypted blob per unique chunk, named by its ID
+//	snapshots/0123…   one encrypted manifest per snapshot
+//
+// Every blob is a cryptod stream whose associated data names the blob, so
+// blobs cannot be swapped for one another. Chunk IDs are an HMAC of the
+// chunk under a key derived from the repository key, so they don't reveal
+// plaintext hashes.
+
+const repositoryVersion = 1
+
+// Repository is a directory of encrypted, content-addressed chunks and
+// snapshot manifests, for incremental backups. Files are cut into
+// content-defined chunks and each unique chunk is stored once, so successive
+// backups of mostly unchanged data only store what changed.
+//
+// A Repository is not safe for concurrent use, and Prune must not run while
+// another process backs up to the same directory.
+type Repository struct {
+	dir   string
+	key   *Key
+	idKey []byte // keys chunk IDs
+	o     *options
+}
+
+// Snapshot describes one backup in a repository.
+type Snapshot struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Files  int       `json:"files"`
+	Size   int64     `json:"size"`   // total size of the files
+	Chunks int       `json:"chunks"` // chunks referenced, counting repeats
+
+	// NewChunks and NewBytes count the chunks, and their plaintext bytes,
+	// that Backup had to store because no earlier snapshot had them. They
+	// are zero in snapshots returned by List.
+	NewChunks int   `json:"-"`
+	NewBytes  int64 `json:"-"`
+}
+
+// PruneReport describes what Prune removed.
+type PruneReport struct {
+	Chunks int   // chunk blobs removed
+	Bytes  int64 // size of the removed blobs
+}
+
+// repositoryConfig is stored, encrypted, in the config blob
+type repositoryConfig struct {
+	Version int `json:"version"`
+}
+
+// manifest is stored, encrypted, for each snapshot
+type manifest struct {
+	Snapshot
+	Entries []manifestEntry `json:"entries"`
+}
+
+// manifestEntry is a file or directory in a snapshot
+type manifestEntry struct {
+	Path    string      `json:"path"` // slash separated, relative to the backup root
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Size    int64       `json:"size,omitempty"`
+	Chunks  []string    `json:"chunks,omitempty"`
+}
+
+// OpenRepository opens the repository in `dir`, creating it if `dir` is
+// empty or does not exist. The key of an existing repository is checked
+// against its config; a wrong key fails with ErrAuthentication.
+//
+// Files are cut into chunks of the default content-defined sizes; pass
+// WithContentDefinedChunking in `opts` to choose others. Other options are
+// ignored.
+func OpenRepository(dir string, skey string, opts ...Option) (*Repository, error) {
+	return OpenRepositoryWithKey(dir, passphraseKey(skey), opts...)
+}
+
+// OpenRepositoryWithKey is like OpenRepository but takes the key as a Key.
+// The repository uses `key` until it is destroyed.
+func OpenRepositoryWithKey(dir string, key *Key, opts ...Option) (*Repository, error) {
+	if err := key.check(); err != nil {
+		return nil, err
+	}
+	o := newOptions(append([]Option{WithContentDefinedChunking(0, 0, 0)}, opts...))
+	master := key.master()
+	defer clear(master[:])
+	idKey, err := hkdf.Key(sha256.New, master[:], nil, "cryptod repository chunk id", 32)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repository{dir: dir, key: key, idKey: idKey, o: o}
+
+	var cfg repositoryConfig
+	err = repo.readJSON(repo.configPath(), "config", &cfg)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := repo.init(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case cfg.Version != repositoryVersion:
+		return nil, fmt.Errorf("%w: version %d", ErrRepository, cfg.Version)
+	}
+	return repo, nil
+}
+
+// init creates a new repository
+func (repo *Repository) init() error {
+	entries, err := os.ReadDir(repo.dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%w: %s is not empty and has no config", ErrRepository, repo.dir)
+	}
+	for _, d := range []string{"chunks", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(repo.dir, d), 0700); err != nil {
+			return err
+		}
+	}
+	return repo.writeJSON(repo.configPath(), "config", repositoryConfig{Version: repositoryVersion})
+}
+
+// Backup stores every regular file and directory of `fsys` as a new
+// snapshot. Other file types, such as symlinks, are skipped.
+func (repo *Repository) Backup(fsys fs.FS) (*Snapshot, error) {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	m := &manifest{Snapshot: Snapshot{ID: hex.EncodeToString(id), Time: time.Now().UTC()}}
+	buf := make([]byte, chunkSize)
+	defer clear(buf)
+
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := manifestEntry{Path: path, Mode: info.Mode(), ModTime: info.ModTime()}
+		if !d.IsDir() {
+			if err := repo.backupFile(fsys, &e, &m.Snapshot, buf); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			m.Files++
+			m.Size += e.Size
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.writeJSON(repo.snapshotPath(m.ID), "snapshot "+m.ID, m); err != nil {
+		return nil, err
+	}
+	return &m.Snapshot, nil
+}
+
+// backupFile stores the chunks of file `e` not yet in the repository
+func (repo *Repository) backupFile(fsys fs.FS, e *manifestEntry, s *Snapshot, buf []byte) error {
+	f, err := fsys.Open(e.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	src, err := newChunker(f, repo.key, repo.o)
+	if err != nil {
+		return err
+	}
+	defer src.wipe()
+	for {
+		n, readErr := src.next(buf)
+		if n > 0 {
+			id := repo.chunkID(buf[:n])
+			stored, err := repo.storeChunk(id, buf[:n])
+			if err != nil {
+				return err
+			}
+			if stored {
+				s.NewChunks++
+				s.NewBytes += int64(n)
+			}
+			e.Chunks = append(e.Chunks, id)
+			e.Size += int64(n)
+			s.Chunks++
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// storeChunk writes chunk `p` with ID `id` unless the repository has it, and
+// reports whether it was written
+func (repo *Repository) storeChunk(id string, p []byte) (bool, error) {
+	path := repo.chunkPath(id)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, err
+	}
+	return true, repo.writeBlob(path, "chunk "+id, bytes.NewReader(p))
+}
+
+// Restore writes the files and directories of snapshot `id` under `dir`,
+// creating it if needed and replacing files that exist. Every chunk is
+// authenticated, and checked against its ID, before it is written.
+func (repo *Repository) Restore(id string, dir string) error {
+	m, err := repo.manifest(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, e := range m.Entries {
+		if !fs.ValidPath(e.Path) {
+			return fmt.Errorf("%w: snapshot %s has invalid path %q", ErrRepository, id, e.Path)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if e.Mode.IsDir() {
+			if err := os.MkdirAll(path, e.Mode.Perm()|0700); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := repo.restoreFile(path, e); err != nil {
+			return fmt.Errorf("%s: %w", e.Path, err)
+		}
+	}
+	// set directory modes and times last, children first
+	for i := len(m.Entries) - 1; i >= 0; i-- {
+		e := m.Entries[i]
+		if !e.Mode.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if err := os.Chmod(path, e.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, e.ModTime, e.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFile writes the chunks of file `e` to `path`
+func (repo *Repository) restoreFile(path string, e manifestEntry) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, e.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	defer func() {
+		b := buf.Bytes()
+		clear(b[:cap(b)])
+	}()
+	for _, id := range e.Chunks {
+		buf.Reset()
+		if err := repo.readBlob(repo.chunkPath(id), "chunk "+id, buf); err != nil {
+			f.Close()
+			return err
+		}
+		if !hmac.Equal([]byte(repo.chunkID(buf.Bytes())), []byte(id)) {
+			f.Close()
+			return fmt.Errorf("chunk %s: %w", id, ErrAuthentication)
+		}
+		if _, err := f.Write(buf.Bytes()); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, e.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(path, e.ModTime, e.ModTime)
+}
+
+// List returns the snapshots in the repository, oldest first.
+func (repo *Repository) List() ([]Snapshot, error) {
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]Snapshot, 0, len(ids))
+	for _, id := range ids {
+		m, err := repo.manifest(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, m.Snapshot)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// Forget removes snapshot `id`. Its chunks stay in the repository until
+// Prune removes those no other snapshot uses.
+func (repo *Repository) Forget(id string) error {
+	if _, err := repo.manifest(id); err != nil {
+		return err
+	}
+	return os.Remove(repo.snapshotPath(id))
+}
+
+// Prune removes the chunks that no snapshot refers to.
+func (repo *Repository) Prune() (*PruneReport, error) {
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	for _, id := range ids {
+		m, err := repo.manifest(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range m.Entries {
+			for _, c := range e.Chunks {
+				used[c] = true
+			}
+		}
+	}
+
+	report := &PruneReport{}
+	err = filepath.WalkDir(filepath.Join(repo.dir, "chunks"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || used[d.Name()] {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		report.Chunks++
+		report.Bytes += info.Size()
+		return nil
+	})
+	return report, err
+}
+
+// chunkID returns the ID of chunk `p`
+func (repo *Repository) chunkID(p []byte) string {
+	mac := hmac.New(sha256.New, repo.idKey)
+	mac.Write(p)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// manifest reads the manifest of snapshot `id`
+func (repo *Repository) manifest(id string) (*manifest, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, fmt.Errorf("snapshot %q: %w", id, fs.ErrNotExist)
+	}
+	m := &manifest{}
+	if err := repo.readJSON(repo.snapshotPath(id), "snapshot "+id, m); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	if m.ID != id {
+		return nil, fmt.Errorf("%w: snapshot %s names itself %s", ErrRepository, id, m.ID)
+	}
+	return m, nil
+}
+
+// snapshotIDs returns the IDs of the stored snapshots
+func (repo *Repository) snapshotIDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(repo.dir, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && filepath.Ext(e.Name()) == "" {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (repo *Repository) configPath() string {
+	return filepath.Join(repo.dir, "config")
+}
+
+func (repo *Repository) snapshotPath(id string) string {
+	return filepath.Join(repo.dir, "snapshots", id)
+}
+
+func (repo *Repository) chunkPath(id string) string {
+	return filepath.Join(repo.dir, "chunks", id[:2], id)
+}
+
+// writeJSON encrypts `v` as JSON to the blob at `path` named `name`
+func (repo *Repository) writeJSON(path string, name string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return repo.writeBlob(path, name, bytes.NewReader(b))
+}
+
+// readJSON decrypts the JSON blob at `path` named `name` into `v`
+func (repo *Repository) readJSON(path string, name string, v any) error {
+	buf := &bytes.Buffer{}
+	if err := repo.readBlob(path, name, buf); err != nil {
+		return err
+	}
+	return json.Unmarshal(buf.Bytes(), v)
+}
+
+// writeBlob encrypts `r` to the blob at `path` named `name`. The blob is
+// written to a temporary file and renamed into place, so it is either
+// complete or absent.
+func (repo *Repository) writeBlob(path string, name string, r io.Reader) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := EncryptWithKey(r, f, repo.key, blobData(name)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readBlob decrypts the blob at `path` named `name` to `w`
+func (repo *Repository) readBlob(path string, name string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return DecryptWithKey(f, w, repo.key, blobData(name))
+}
+
+// blobData binds a blob to its name
+func blobData(name string) Option {
+	return WithAssociatedData([]byte("cryptod repository " + name))
+}
@@ -0,0 +1,213 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// repoChunks returns the number of chunk blobs in the repository in `dir`
+func repoChunks(t *testing.T, dir string) int {
+	n := 0
+	err := filepath.WalkDir(filepath.Join(dir, "chunks"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// checkRestored compares the files restored in `dir` with `want`
+func checkRestored(t *testing.T, dir string, want fstest.MapFS) {
+	t.Helper()
+	for name, f := range want {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if f.Mode.IsDir() {
+			if !info.IsDir() {
+				t.Errorf("%s: expected a directory", name)
+			}
+			continue
+		}
+		got, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(got, f.Data) {
+			t.Errorf("%s: content mismatch (%v)", name, err)
+		}
+		if info.Mode().Perm() != f.Mode.Perm() || !info.ModTime().Equal(f.ModTime) {
+			t.Errorf("%s: expected mode %v and time %v, got %v and %v", name, f.Mode.Perm(), f.ModTime, info.Mode().Perm(), info.ModTime())
+		}
+	}
+}
+
+func TestRepository(t *testing.T) {
+	const key = "secret key"
+	dir := filepath.Join(t.TempDir(), "repo")
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	dump := randomText(3, 3*1024*1024)
+
+	repo, err := OpenRepository(dir, key, WithContentDefinedChunking(16*1024, 64*1024, 256*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := fstest.MapFS{
+		"db.dump":         {Data: dump, Mode: 0600, ModTime: mtime},
+		"etc/app.conf":    {Data: []byte("debug = false\n"), Mode: 0644, ModTime: mtime},
+		"etc/copy.conf":   {Data: []byte("debug = false\n"), Mode: 0644, ModTime: mtime},
+		"empty":           {Data: nil, Mode: 0600, ModTime: mtime},
+		"var/cache/empty": {Mode: fs.ModeDir | 0755, ModTime: mtime},
+	}
+	s1, err := repo.Backup(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1.Files != 4 || s1.Size != int64(len(dump)+28) || s1.NewChunks != s1.Chunks-1 {
+		t.Errorf("unexpected first snapshot %+v", s1)
+	}
+	if n := repoChunks(t, dir); n != s1.NewChunks {
+		t.Errorf("expected %d chunk blobs, got %d", s1.NewChunks, n)
+	}
+
+	// insert a byte early in the dump: only the chunks around it are new
+	edited := append(append(append([]byte(nil), dump[:5000]...), 'x'), dump[5000:]...)
+	v2 := fstest.MapFS{
+		"db.dump":      {Data: edited, Mode: 0600, ModTime: mtime.Add(time.Hour)},
+		"etc/app.conf": v1["etc/app.conf"],
+	}
+	s2, err := repo.Backup(v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.NewChunks > 2 || s2.NewBytes > 512*1024 {
+		t.Errorf("expected few new chunks, got %d (%d bytes) of %d", s2.NewChunks, s2.NewBytes, s2.Chunks)
+	}
+
+	// the plaintext is not visible in the repository
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if bytes.Contains(b, []byte("debug = false")) || bytes.Contains(b, dump[:64]) {
+			t.Errorf("%s holds plaintext", path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen and list
+	repo, err = OpenRepository(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := repo.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != s1.ID || list[1].ID != s2.ID || list[0].Files != 4 {
+		t.Fatalf("unexpected snapshots %+v", list)
+	}
+
+	for _, tt := range []struct {
+		id   string
+		want fstest.MapFS
+	}{{s1.ID, v1}, {s2.ID, v2}} {
+		out := t.TempDir()
+		if err := repo.Restore(tt.id, out); err != nil {
+			t.Fatalf("restore %s: %v", tt.id, err)
+		}
+		checkRestored(t, out, tt.want)
+	}
+
+	// forget the first snapshot and prune the chunks only it used
+	before := repoChunks(t, dir)
+	if err := repo.Forget(s1.ID); err != nil {
+		t.Fatal(err)
+	}
+	report, err := repo.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Chunks == 0 || report.Chunks > 3 || repoChunks(t, dir) != before-report.Chunks {
+		t.Errorf("unexpected prune report %+v", report)
+	}
+	out := t.TempDir()
+	if err := repo.Restore(s2.ID, out); err != nil {
+		t.Fatalf("restore after prune: %v", err)
+	}
+	checkRestored(t, out, v2)
+	if err := repo.Restore(s1.ID, out); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("forgotten snapshot: expected fs.ErrNotExist, got %v", err)
+	}
+}
+
+func TestRepositoryErrors(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := OpenRepository(dir, "secret key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := repo.Backup(fstest.MapFS{"a": {Data: []byte("hello"), Mode: 0600}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenRepository(dir, "wrong key"); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("wrong key: expected ErrAuthentication, got %v", err)
+	}
+	notRepo := t.TempDir()
+	writeFile(t, notRepo, "file", []byte("data"))
+	if _, err := OpenRepository(notRepo, "key"); !errors.Is(err, ErrRepository) {
+		t.Errorf("directory without config: expected ErrRepository, got %v", err)
+	}
+
+	// a chunk blob swapped for another is rejected
+	var chunks []string
+	filepath.WalkDir(filepath.Join(dir, "chunks"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			chunks = append(chunks, path)
+		}
+		return err
+	})
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(chunks))
+	}
+	if _, err := repo.Backup(fstest.MapFS{"b": {Data: []byte("other"), Mode: 0600}}); err != nil {
+		t.Fatal(err)
+	}
+	var other string
+	filepath.WalkDir(filepath.Join(dir, "chunks"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && path != chunks[0] {
+			other = path
+		}
+		return err
+	})
+	b, err := os.ReadFile(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(chunks[0], b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Restore(s.ID, t.TempDir()); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("swapped chunk: expected ErrAuthentication, got %v", err)
+	}
+
+	if err := repo.Restore("../config", t.TempDir()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("bad snapshot ID: expected fs.ErrNotExist, got %v", err)
+	}
+}
@@ -3,6 +3,8 @@ package cryptod
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"testing"
 )
 
@@ -155,6 +157,95 @@ func TestChunkDuplication(t *testing.T) {
 	}
 }
 
+// TestCrossStreamSplicing verifies that a chunk cannot be moved into another
+// stream encrypted with the same key, even at the same position, and that a
+// stream's chunks are not accepted under another stream's header.
+func TestCrossStreamSplicing(t *testing.T) {
+	chunkSize := 1024 * 1000
+	plaintext := make([]byte, chunkSize*3)
+	for i := range plaintext {
+		plaintext[i] = byte(i % 251)
+	}
+	key := "test_secret_key"
+
+	encrypt := func() []byte {
+		var encrypted bytes.Buffer
+		if err := Encrypt(bytes.NewReader(plaintext), &encrypted, key); err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		return encrypted.Bytes()
+	}
+	chunksA, headerA, tombA := parseEncryptedStream(t, encrypt())
+	chunksB, headerB, _ := parseEncryptedStream(t, encrypt())
+
+	// Splice the second chunk of stream B into stream A
+	spliced := bytes.Buffer{}
+	spliced.Write(headerA)
+	spliced.Write(chunksA[0])
+	spliced.Write(chunksB[1])
+	spliced.Write(chunksA[2])
+	spliced.Write(tombA)
+	if err := Decrypt(&spliced, io.Discard, key); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Spliced chunk: expected ErrAuthentication, got %v", err)
+	}
+
+	// Stream A's chunks under stream B's header
+	swapped := bytes.Buffer{}
+	swapped.Write(headerB)
+	for _, c := range chunksA {
+		swapped.Write(c)
+	}
+	swapped.Write(tombA)
+	if err := Decrypt(&swapped, io.Discard, key); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Swapped header: expected ErrAuthentication, got %v", err)
+	}
+
+	// A stream sharing A's salt, and so its key and nonces, but with
+	// another stream ID: the ID alone keeps the chunks apart
+	h := &header{}
+	if err := h.read(bytes.NewReader(headerA)); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := parseFields(h.ext, v2Fields...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := append([]byte(nil), fields[fieldStreamID]...)
+	id[0] ^= 1
+	h.set(scheme, FormatV2, marshalFields(
+		headerField{fieldSalt, fields[fieldSalt]},
+		headerField{fieldStreamID, id},
+		headerField{fieldCommit, fields[fieldCommit]},
+	))
+	enc, err := newStreamEncoder(h, NewKey([]byte(key)), newOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, enc.nonceSize())
+	sealed, err := enc.seal(nil, nonce, plaintext[chunkSize:chunkSize*2], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nonce, extractNonceFromChunk(t, chunksA[1])) {
+		t.Fatal("Streams with the same salt should share nonces")
+	}
+	forged := bytes.Buffer{}
+	if err := writeChunkHeader(chunkHeader{nonce: nonce, size: uint32(len(sealed))}, &forged); err != nil {
+		t.Fatal(err)
+	}
+	forged.Write(sealed)
+
+	spliced.Reset()
+	spliced.Write(headerA)
+	spliced.Write(chunksA[0])
+	spliced.Write(forged.Bytes())
+	spliced.Write(chunksA[2])
+	spliced.Write(tombA)
+	if err := Decrypt(&spliced, io.Discard, key); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Same salt, other stream ID: expected ErrAuthentication, got %v", err)
+	}
+}
+
 // TestWeakKeyDerivation demonstrates vulnerability to dictionary attacks.
 func TestWeakKeyDerivation(t *testing.T) {
 	plaintext := []byte("sensitive data")
@@ -223,12 +314,13 @@ func TestNonceUniqueness(t *testing.T) {
 
 // Helper function to parse encrypted stream into components
 func parseEncryptedStream(t *testing.T, data []byte) (chunks [][]byte, header []byte, tomb []byte) {
-	// Header is 14 bytes (1 size + 2 magic + 9 scheme + 1 verMaj + 1 verMin)
-	if len(data) < 14 {
+	// Header is 1 size byte followed by that many bytes (2 magic + 9 scheme +
+	// 1 verMaj + 1 verMin + format specific fields)
+	if len(data) < 14 || len(data) < 1+int(data[0]) {
 		t.Fatal("Data too short to contain header")
 	}
-	header = data[:14]
-	pos := 14
+	header = data[:1+int(data[0])]
+	pos := len(header)
 
 	// Parse chunks
 	for pos < len(data) {
@@ -280,12 +372,6 @@ func parseEncryptedStream(t *testing.T, data []byte) (chunks [][]byte, header []
 		}
 		pos += 2
 
-		// If this is a tomb chunk, save it and break
-		if chunkType == 't' {
-			tomb = data[chunkStart:pos]
-			break
-		}
-
 		// Read encrypted data
 		dataEnd := pos + int(chunkSize)
 		if dataEnd > len(data) {
@@ -293,6 +379,12 @@ func parseEncryptedStream(t *testing.T, data []byte) (chunks [][]byte, header []
 				pos, chunkSize, len(data)-pos)
 		}
 
+		// If this is a tomb chunk, save it and break
+		if chunkType == 't' {
+			tomb = data[chunkStart:dataEnd]
+			break
+		}
+
 		// Save entire chunk (header + data)
 		chunks = append(chunks, data[chunkStart:dataEnd])
 		pos = dataEnd
@@ -331,3 +423,54 @@ func indexOf(slice []string, item string) int {
 	}
 	return -1
 }
+
+// chunkGuard fails the test if anything past the stream header is read
+type chunkGuard struct {
+	t *testing.T
+}
+
+func (g chunkGuard) Read(p []byte) (int, error) {
+	g.t.Error("a chunk was read")
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestKeyCommitment(t *testing.T) {
+	const key = "test_secret_key"
+	var encrypted bytes.Buffer
+	if err := Encrypt(bytes.NewReader(make([]byte, 1000)), &encrypted, key); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	_, hdr, _ := parseEncryptedStream(t, encrypted.Bytes())
+
+	// another key is rejected by the header alone
+	for _, workers := range []int{1, 4} {
+		r := io.MultiReader(bytes.NewReader(hdr), chunkGuard{t})
+		err := Decrypt(r, io.Discard, "other key", WithConcurrency(workers))
+		if !errors.Is(err, ErrWrongKey) || !errors.Is(err, ErrAuthentication) {
+			t.Errorf("workers=%d: expected ErrWrongKey, got %v", workers, err)
+		}
+	}
+	if _, err := Verify(io.MultiReader(bytes.NewReader(hdr), chunkGuard{t}), "other key"); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("verify: expected ErrWrongKey, got %v", err)
+	}
+
+	// as is an altered commitment under the right key
+	h := &header{}
+	if err := h.read(bytes.NewReader(hdr)); err != nil {
+		t.Fatal(err)
+	}
+	fields, err := parseFields(h.ext, v2Fields...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := append([]byte(nil), fields[fieldCommit]...)
+	commit[len(commit)-1] ^= 1
+	h.set(scheme, FormatV2, marshalFields(
+		headerField{fieldSalt, fields[fieldSalt]},
+		headerField{fieldStreamID, fields[fieldStreamID]},
+		headerField{fieldCommit, commit},
+	))
+	if err := Decrypt(io.MultiReader(bytes.NewReader(h.marshal()), chunkGuard{t}), io.Discard, key); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("altered commitment: expected ErrAuthentication, got %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package cryptod
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// Writer encrypts the plaintext written to it as one stream, for code that
+// produces data with Write calls rather than handing over an io.Reader. The
+// stream is written to the underlying writer as chunks fill, and ended by
+// Close, which must be called.
+//
+// Write and ReadFrom hand their data to a goroutine running Encrypt, which
+// reads it straight into its chunk buffers; ReadFrom, which io.Copy uses,
+// lets it read the source directly. Each returns once its data is consumed:
+// full chunks are encrypted and written as they fill, while the last chunk
+// and the end marker are written by Close.
+type Writer struct {
+	w       io.Writer
+	key     *Key
+	o       *options
+	feed    *feed         // nil until the goroutine is started
+	br      bytes.Reader  // source handed over by Write
+	stopped chan struct{} // closed when the goroutine returns
+	result  error         // of the goroutine, once stopped is closed
+	err     error         // sticky, ErrStreamClosed once the stream has ended
+}
+
+// NewWriter returns a Writer encrypting to `w` with `key` and `opts`, as
+// EncryptWithKey does.
+func NewWriter(w io.Writer, key *Key, opts ...Option) (*Writer, error) {
+	if err := key.check(); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, key: key, o: newOptions(opts)}, nil
+}
+
+// NewWriter returns a Writer encrypting to `w` with the Encryptor's key and
+// options, recycling its buffers.
+func (e *Encryptor) NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, key: e.key, o: e.o}
+}
+
+// Write encrypts `p`. An error writing the stream is returned by this or the
+// next Write, or by Close.
+func (sw *Writer) Write(p []byte) (int, error) {
+	sw.br.Reset(p)
+	n, err := sw.send(&sw.br)
+	return int(n), err
+}
+
+// ReadFrom encrypts `r` until io.EOF, leaving the stream open for more writes.
+// An error reading `r` is returned without ending the stream.
+func (sw *Writer) ReadFrom(r io.Reader) (int64, error) {
+	return sw.send(r)
+}
+
+// Close ends the stream, writing its last chunk and end marker, and returns
+// the first error encrypting it. It does not close the underlying writer.
+func (sw *Writer) Close() error {
+	if sw.err == ErrStreamClosed {
+		return nil
+	}
+	sw.start()
+	close(sw.feed.src)
+	<-sw.stopped
+	sw.err = ErrStreamClosed
+	return sw.result
+}
+
+// start starts the goroutine encrypting the feed, once
+func (sw *Writer) start() {
+	if sw.feed != nil {
+		return
+	}
+	sw.feed = &feed{src: make(chan io.Reader), done: make(chan feedResult)}
+	sw.stopped = make(chan struct{})
+	go func() {
+		defer close(sw.stopped)
+		_, sw.result = encryptStream(context.Background(), sw.feed, sw.w, sw.key, sw.o)
+	}()
+}
+
+// send hands `r` to the goroutine and waits until it has been read to io.EOF,
+// returning the number of bytes read from it
+func (sw *Writer) send(r io.Reader) (int64, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	sw.start()
+	select {
+	case sw.feed.src <- r:
+	case <-sw.stopped:
+		sw.err = sw.result
+		return 0, sw.err
+	}
+	select {
+	case res := <-sw.feed.done:
+		return res.n, res.err
+	case <-sw.stopped:
+		// failed writing the stream part way through `r`
+		sw.err = sw.result
+		return sw.feed.n, sw.err
+	}
+}
+
+// feed is the input of a Writer's goroutine: the sources handed over by Write
+// and ReadFrom, read one after the other, until Close ends it with io.EOF
+type feed struct {
+	src  chan io.Reader
+	done chan feedResult // result of reading the current source
+	cur  io.Reader
+	n    int64 // read from cur
+}
+
+type feedResult struct {
+	n   int64
+	err error
+}
+
+func (f *feed) Read(p []byte) (int, error) {
+	for {
+		if f.cur == nil {
+			r, ok := <-f.src
+			if !ok {
+				return 0, io.EOF
+			}
+			f.cur, f.n = r, 0
+		}
+		n, err := f.cur.Read(p)
+		f.n += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			f.cur = nil
+			f.done <- feedResult{n: f.n, err: err}
+		}
+		if n > 0 || len(p) == 0 {
+			return n, nil
+		}
+	}
+}
+
+// Reader decrypts a stream read from an underlying reader, for code that
+// consumes data with Read calls rather than handing over an io.Writer.
+//
+// Plaintext is returned only once the chunk holding it is authenticated, but
+// a stream is only known to be complete when Read returns io.EOF: an error
+// after some plaintext has been read means that plaintext must be discarded,
+// as with Decrypt.
+//
+// Reads are served by a goroutine running Decrypt through a pipe, which Close
+// stops. WriteTo, which io.Copy uses, skips the pipe when nothing has been
+// read yet and decrypts straight to its writer.
+type Reader struct {
+	r    io.Reader
+	key  *Key
+	o    *options
+	pr   *io.PipeReader
+	stop context.CancelFunc
+	done chan struct{}
+	err  error // sticky, io.EOF once WriteTo has read the stream
+}
+
+// NewReader returns a Reader decrypting `r` with `key` and `opts`, as
+// DecryptWithKey does.
+func NewReader(r io.Reader, key *Key, opts ...Option) (*Reader, error) {
+	if err := key.check(); err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, key: key, o: newOptions(opts)}, nil
+}
+
+// NewReader returns a Reader decrypting `r` with the Decryptor's key and
+// options, recycling its buffers.
+func (d *Decryptor) NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, key: d.key, o: d.o}
+}
+
+// Read reads decrypted plaintext into `p`
+func (sr *Reader) Read(p []byte) (int, error) {
+	if sr.err != nil {
+		return 0, sr.err
+	}
+	if sr.pr == nil {
+		pr, pw := io.Pipe()
+		ctx, stop := context.WithCancel(context.Background())
+		sr.pr, sr.stop, sr.done = pr, stop, make(chan struct{})
+		go func() {
+			defer close(sr.done)
+			_, _, err := decryptStream(ctx, sr.r, pw, sr.key, sr.o)
+			pw.CloseWithError(err) // io.EOF when err is nil
+		}()
+	}
+	return sr.pr.Read(p)
+}
+
+// WriteTo writes the decrypted plaintext to `w` until the end of the stream.
+// If nothing has been read yet, the stream is decrypted directly to `w`, as
+// Decrypt does; otherwise the rest is copied as by Read.
+func (sr *Reader) WriteTo(w io.Writer) (int64, error) {
+	if sr.err != nil || sr.pr != nil {
+		return io.Copy(w, readerOnly{sr})
+	}
+	cw := &countingWriter{w: w}
+	_, _, err := decryptStream(context.Background(), sr.r, cw, sr.key, sr.o)
+	sr.err = err
+	if err == nil {
+		sr.err = io.EOF
+	}
+	return cw.n, err
+}
+
+// Close stops decrypting and releases the goroutine serving reads, waiting
+// for a read of the underlying reader in progress to return. It does not
+// close the underlying reader.
+func (sr *Reader) Close() error {
+	if sr.pr != nil {
+		sr.stop()
+		sr.pr.CloseWithError(ErrStreamClosed)
+		<-sr.done
+	}
+	sr.err = ErrStreamClosed
+	return nil
+}
+
+// readerOnly hides WriteTo from io.Copy
+type readerOnly struct{ io.Reader }
@@ -0,0 +1,167 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestWriter(t *testing.T) {
+	key := NewKey([]byte("this is a secret"))
+	for _, size := range []int{0, 100, chunkSize*2 + 100} {
+		plaintext := generatePlainText(size)
+		want := &bytes.Buffer{}
+		if err := EncryptWithKey(bytes.NewReader(plaintext), want, key, WithDeterministic()); err != nil {
+			t.Fatal(err)
+		}
+
+		// written in pieces
+		buf := &bytes.Buffer{}
+		w, err := NewWriter(buf, key, WithDeterministic())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for p := plaintext; len(p) > 0; p = p[min(len(p), 1000):] {
+			if _, err := w.Write(p[:min(len(p), 1000)]); err != nil {
+				t.Fatalf("size=%d: write error: %v", size, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("size=%d: close error: %v", size, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+			t.Errorf("size=%d: written stream differs from Encrypt", size)
+		}
+
+		// io.Copy uses ReadFrom, and the stream stays open for more writes,
+		// whether or not the source implements io.WriterTo
+		enc, _ := NewEncryptor(key, WithDeterministic())
+		half := size / 2
+		for name, src := range map[string]io.Reader{
+			"reader":   iotest.OneByteReader(bytes.NewReader(plaintext[:half])),
+			"writerTo": bytes.NewReader(plaintext[:half]),
+		} {
+			buf = &bytes.Buffer{}
+			w = enc.NewWriter(buf)
+			if n, err := io.Copy(w, src); err != nil || n != int64(half) {
+				t.Fatalf("size=%d %s: copy returned %d, %v", size, name, n, err)
+			}
+			if _, err := w.Write(plaintext[half:]); err != nil {
+				t.Fatalf("size=%d %s: write after copy: %v", size, name, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+				t.Errorf("size=%d %s: copied stream differs from Encrypt", size, name)
+			}
+			if _, err := w.Write([]byte("x")); !errors.Is(err, ErrStreamClosed) {
+				t.Errorf("write after close: expected ErrStreamClosed, got %v", err)
+			}
+		}
+	}
+
+	// a read error is returned by ReadFrom without ending the stream
+	w, _ := NewWriter(io.Discard, key)
+	rerr := errors.New("read failed")
+	if _, err := w.ReadFrom(iotest.ErrReader(rerr)); err != rerr {
+		t.Errorf("expected the read error, got %v", err)
+	}
+	if _, err := w.Write([]byte("more")); err != nil {
+		t.Errorf("write after a read error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("close after a read error: %v", err)
+	}
+
+	// a write error is returned by Write or Close
+	w, _ = NewWriter(&failingWriter{}, key)
+	_, werr := w.Write(generatePlainText(chunkSize * 3))
+	if cerr := w.Close(); werr == nil && cerr == nil {
+		t.Error("expected an error writing to a failing writer")
+	}
+}
+
+func TestReader(t *testing.T) {
+	key := NewKey([]byte("this is a secret"))
+	for _, size := range []int{0, 100, chunkSize*2 + 100} {
+		plaintext := generatePlainText(size)
+		buf := &bytes.Buffer{}
+		if err := EncryptWithKey(bytes.NewReader(plaintext), buf, key); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		// read in small pieces through the pipe
+		r, err := NewReader(bytes.NewReader(data), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(iotest.OneByteReader(r))
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("size=%d: read error: %v", size, err)
+		}
+		r.Close()
+
+		// io.Copy uses WriteTo, which decrypts to the writer directly
+		dec, _ := NewDecryptor(key)
+		r = dec.NewReader(bytes.NewReader(data))
+		out := &bytes.Buffer{}
+		if n, err := io.Copy(out, r); err != nil || n != int64(size) || !bytes.Equal(out.Bytes(), plaintext) {
+			t.Errorf("size=%d: copy returned %d, %v", size, n, err)
+		}
+		if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+			t.Errorf("size=%d: read after copy returned %d, %v", size, n, err)
+		}
+
+		// after a first Read, io.Copy goes on through the pipe
+		r = dec.NewReader(bytes.NewReader(data))
+		head := make([]byte, min(size, 10))
+		if _, err := io.ReadFull(r, head); err != nil {
+			t.Fatal(err)
+		}
+		out.Reset()
+		if _, err := io.Copy(out, r); err != nil || !bytes.Equal(append(head, out.Bytes()...), plaintext) {
+			t.Errorf("size=%d: copy after read: %v", size, err)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	key := NewKey([]byte("this is a secret"))
+	buf := &bytes.Buffer{}
+	if err := EncryptWithKey(bytes.NewReader(generatePlainText(chunkSize*2+100)), buf, key); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-200]++
+
+	r, _ := NewReader(bytes.NewReader(tampered), key)
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("read: expected ErrAuthentication, got %v", err)
+	}
+	r, _ = NewReader(bytes.NewReader(data[:len(data)-10]), key)
+	if _, err := io.Copy(io.Discard, r); !errors.Is(err, ErrTruncated) {
+		t.Errorf("copy: expected ErrTruncated, got %v", err)
+	}
+
+	// Close stops the goroutine part way through the stream
+	r, _ = NewReader(bytes.NewReader(data), key)
+	if _, err := r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 10)); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("read after close: expected ErrStreamClosed, got %v", err)
+	}
+
+	key.Destroy()
+	if _, err := NewReader(bytes.NewReader(data), key); !errors.Is(err, ErrKeyDestroyed) {
+		t.Errorf("destroyed key: expected ErrKeyDestroyed, got %v", err)
+	}
+}
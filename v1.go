@@ -0,0 +1,140 @@
+package cryptod
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Format 1.0: each chunk nonce starts with the uvarint chunk counter followed
+// by random bytes, and the AAD is the little-endian 32-bit chunk counter. The
+// end of stream marker carries a random nonce and no payload.
+
+func init() {
+	registerFormat(&formatSpec{
+		scheme:     scheme,
+		format:     FormatV1,
+		deprecated: true,
+		newEncoder: func(h *header, key *Key, o *options) (encoder, error) {
+			if len(o.ad) != 0 {
+				return nil, errNotSupported(FormatV1, "associated data")
+			}
+			if o.deterministic {
+				return nil, errNotSupported(FormatV1, "deterministic mode")
+			}
+			if o.chunking != nil {
+				return nil, errNotSupported(FormatV1, "content-defined chunking")
+			}
+			if key.raw {
+				return nil, errNotSupported(FormatV1, "raw keys")
+			}
+			gcm, err := getGCM(key)
+			if err != nil {
+				return nil, err
+			}
+			return v1Codec{gcm: gcm}, nil
+		},
+		newDecoder: func(h *header, key *Key, o *options) (decoder, error) {
+			if len(h.ext) != 0 {
+				return nil, errExtraHeader
+			}
+			if len(o.ad) != 0 {
+				return nil, errNotSupported(FormatV1, "associated data")
+			}
+			if key.raw {
+				return nil, errNotSupported(FormatV1, "raw keys")
+			}
+			gcm, err := getGCM(key)
+			if err != nil {
+				return nil, err
+			}
+			return v1Codec{gcm: gcm}, nil
+		},
+	})
+}
+
+// v1Codec seals and opens format 1.0 chunks
+type v1Codec struct {
+	gcm cipher.AEAD
+}
+
+func (v v1Codec) header() *header {
+	h := &header{}
+	h.set(scheme, FormatV1, nil)
+	return h
+}
+
+func (v v1Codec) nonceSize() int {
+	return v.gcm.NonceSize()
+}
+
+func (v v1Codec) overhead() int {
+	return v.gcm.Overhead()
+}
+
+func (v v1Codec) seal(dst []byte, nonce []byte, p []byte, ctr uint64) ([]byte, error) {
+	if ctr == 0 || ctr > math.MaxUint32 {
+		return nil, ErrCounterExhausted
+	}
+	// randomize the nonce
+	if _, err := io.ReadFull(rand.Reader, nonce[binary.MaxVarintLen32:]); err != nil {
+		return nil, err
+	}
+	binary.PutUvarint(nonce, ctr)
+	// encrypt and authenticate with AAD binding chunk counter
+	aad := v1AAD(ctr)
+	defer aadBufs.Put(aad)
+	return v.gcm.Seal(dst[:0], nonce, p, *aad), nil
+}
+
+func (v v1Codec) sealTomb(dst []byte, nonce []byte, ctr uint64) ([]byte, error) {
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return dst[:0], nil
+}
+
+func (v v1Codec) open(c []byte, nonce []byte, ctr uint64) ([]byte, error) {
+	if ctr > math.MaxUint32 {
+		return nil, ErrCounterExhausted
+	}
+	// decrypt the chunk with AAD verification
+	aad := v1AAD(ctr)
+	defer aadBufs.Put(aad)
+	p, err := v.gcm.Open(c[:0], nonce, c, *aad)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return p, nil
+}
+
+func (v v1Codec) openTomb(c []byte, nonce []byte, ctr uint64) error {
+	// the marker is not authenticated in this format
+	if len(c) != 0 {
+		return fmt.Errorf("%w: unexpected end of stream payload", ErrBadChunk)
+	}
+	return nil
+}
+
+func (v v1Codec) counter(nonce []byte) (uint64, bool) {
+	if len(nonce) < binary.MaxVarintLen32 {
+		return 0, false
+	}
+	ctr, n := binary.Uvarint(nonce[:binary.MaxVarintLen32])
+	return ctr, n > 0
+}
+
+func (v v1Codec) variableChunks() bool {
+	return false
+}
+
+// v1AAD returns the AAD for chunk number `ctr`, binding the chunk sequence,
+// in a buffer from aadBufs
+func v1AAD(ctr uint64) *[]byte {
+	aad := aadBufs.Get().(*[]byte)
+	*aad = binary.LittleEndian.AppendUint32((*aad)[:0], uint32(ctr))
+	return aad
+}
@@ -0,0 +1,487 @@
+package cryptod
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sync"
+)
+
+// FormatV2 uses 64-bit chunk counters and a key per stream. It is the
+// default format.
+var FormatV2 = Format{Major: 2, Minor: 0}
+
+// Format 2.0: the header carries a random salt, from which a stream key and
+// a 4-byte nonce prefix are derived with HKDF-SHA256. Each chunk nonce is the
+// prefix followed by the big-endian 64-bit chunk counter, so nonces never
+// repeat within a stream and, with a fresh key per stream, never repeat at
+// all. The header also carries a random stream ID. The AAD is the stream ID,
+// the SHA-256 digests of the header and of the caller's associated data, the
+// counter and a flag marking the end of stream marker, which is sealed like
+// an empty final chunk, so truncation is authenticated and chunks cannot be
+// moved between streams or kept with an altered header. Counters start at 1;
+// encryption fails rather than wrap.
+//
+// GCM alone is not key-committing: a ciphertext can be crafted that opens
+// under two chosen keys. The header therefore carries a commitment to the
+// key, derived from it and the salt with HKDF, which decryption checks in
+// constant time before any chunk is read. Only the key it was derived from
+// gives the same commitment, and it is covered by the header digest in the
+// AAD, so no stream is valid under two keys. A mismatch is reported as
+// ErrWrongKey, as the commitment doubles as a key check value: it reveals
+// nothing about the key, being an HKDF output.
+//
+// In deterministic mode, flagged in the header, the salt and stream ID are
+// derived from the key instead of drawn at random, and each chunk nonce is
+// the HMAC-SHA256 of the AAD and plaintext under a key derived like the
+// stream key, truncated to 12 bytes (a synthetic IV, as in SIV). Decryption
+// recomputes the nonce from the opened plaintext and checks it. Equal
+// plaintexts under the same key and associated data give equal streams.
+// Another flag marks streams with content-defined chunk sizes, which only
+// matters to Recover, and a third streams encrypted with a raw key, which
+// must then be decrypted with a raw key: the flag is authenticated with the
+// header, and keeps a raw key and a passphrase with the same bytes apart.
+//
+// Deterministic streams under one key and associated data share their salt,
+// stream ID and header digest, so chunk AADs alone would not tell them apart,
+// and chunk N of one stream would open at position N of another. Their chunks
+// are therefore bound at the end: each chunk adds an HMAC of its counter and
+// nonce, under a third derived key, to an XOR accumulator, and the end
+// marker's AAD carries the accumulator after its counter, so a stream with a
+// chunk from another one fails at its end marker. Such streams cannot be
+// checkpointed, since the accumulator is not in the checkpoint.
+//
+// Deterministic streams with content-defined chunks are also flagged as
+// content-addressed: a chunk's AAD leaves out the counter, so its nonce and
+// ciphertext depend only on its plaintext, and a chunk that an edit did not
+// touch is byte-identical in the next version of the stream even though its
+// position changed. Their order is then bound by the accumulator alone:
+// reordered, dropped or repeated chunks are detected only at the end marker.
+
+const (
+	v2SaltSize     = 16
+	v2StreamIDSize = 16
+	v2PrefixSize   = 4
+	v2CommitSize   = 32
+
+	fieldSalt     = 's' // header field holding the stream salt
+	fieldStreamID = 'i' // header field holding the stream ID
+	fieldFlags    = 'f' // header field holding mode flags, omitted if none are set
+	fieldCommit   = 'c' // header field holding the key commitment
+
+	flagDeterministic  = 1 << 0 // synthetic nonces, see WithDeterministic
+	flagContentDefined = 1 << 1 // chunk sizes vary, see WithContentDefinedChunking
+	flagRawKey         = 1 << 2 // encrypted with a raw key, see NewRawKey
+	flagAddressed      = 1 << 3 // chunk AADs have no counter; set with both flags above
+	v2KnownFlags       = flagDeterministic | flagContentDefined | flagRawKey | flagAddressed
+)
+
+// errDeterministicCheckpoint is returned when checkpoints are used with a
+// deterministic stream
+var errDeterministicCheckpoint = errors.New("checkpoints are not supported for deterministic streams")
+
+// v2Fields are the header fields of format 2.0
+var v2Fields = []byte{fieldSalt, fieldStreamID, fieldFlags, fieldCommit}
+
+func init() {
+	registerFormat(&formatSpec{
+		scheme:     scheme,
+		format:     FormatV2,
+		committing: true,
+		newEncoder: func(h *header, key *Key, o *options) (encoder, error) {
+			if h == nil {
+				var err error
+				if h, err = newV2Header(key, o); err != nil {
+					return nil, err
+				}
+			}
+			return newV2Codec(h, key, o)
+		},
+		newDecoder: func(h *header, key *Key, o *options) (decoder, error) {
+			return newV2Codec(h, key, o)
+		},
+		describe: func(h *header, info *StreamInfo) {
+			if fields, err := parseFields(h.ext, v2Fields...); err == nil {
+				flags := fields[fieldFlags]
+				info.Deterministic = len(flags) == 1 && flags[0]&flagDeterministic != 0
+				info.ContentDefined = len(flags) == 1 && flags[0]&flagContentDefined != 0
+				info.RawKey = len(flags) == 1 && flags[0]&flagRawKey != 0
+			}
+		},
+	})
+}
+
+// newV2Header returns the header of a new stream
+func newV2Header(key *Key, o *options) (*header, error) {
+	rnd := make([]byte, v2SaltSize+v2StreamIDSize)
+	var fields []headerField
+	var flags byte
+	if o.chunking != nil {
+		flags |= flagContentDefined
+	}
+	if key.raw {
+		flags |= flagRawKey
+	}
+	master := key.master()
+	defer clear(master[:])
+	if o.deterministic {
+		// streams under one key share a salt and ID, so equal inputs
+		// produce equal headers
+		var err error
+		rnd, err = hkdf.Key(sha256.New, master[:], nil, "cryptod 2 deterministic stream", len(rnd))
+		if err != nil {
+			return nil, err
+		}
+		flags |= flagDeterministic
+		if o.chunking != nil {
+			flags |= flagAddressed
+		}
+	} else if _, err := io.ReadFull(rand.Reader, rnd); err != nil {
+		return nil, err
+	}
+	commit, err := v2Commitment(master[:], rnd[:v2SaltSize])
+	if err != nil {
+		return nil, err
+	}
+	if flags != 0 {
+		fields = append(fields, headerField{fieldFlags, []byte{flags}})
+	}
+	fields = append(fields,
+		headerField{fieldSalt, rnd[:v2SaltSize]},
+		headerField{fieldStreamID, rnd[v2SaltSize:]},
+		headerField{fieldCommit, commit},
+	)
+	h := &header{}
+	h.set(scheme, FormatV2, marshalFields(fields...))
+	return h, nil
+}
+
+// v2Codec seals and opens format 2.0 chunks
+type v2Codec struct {
+	h      *header
+	gcm    cipher.AEAD
+	prefix []byte
+	ad     []byte // stream ID, header and associated data digests, leading every chunk's AAD
+	sivKey []byte // key for synthetic nonces in deterministic mode, else nil
+	flags  byte
+
+	// deterministic streams only
+	orderKey  []byte     // key for the order MAC of each chunk, else nil
+	mu        sync.Mutex // guards order, as chunks are sealed and opened in parallel
+	order     [32]byte   // XOR of the order MACs of the chunks sealed or opened
+	sivMACs   macPool    // under sivKey
+	orderMACs macPool    // under orderKey
+}
+
+// macState is an HMAC-SHA256 with buffers for its input counter and output,
+// reused across chunks so that computing a MAC does not allocate
+type macState struct {
+	mac hash.Hash
+	ctr [8]byte
+	sum [sha256.Size]byte
+}
+
+// macPool keeps the MAC states of one stream under one key, for the chunks
+// sealed and opened in parallel to share. Unlike a sync.Pool it is not
+// emptied by the garbage collector, so a stream makes its states once: one
+// per worker up front, and more only if more chunks are processed at once.
+type macPool struct {
+	key  []byte
+	mu   sync.Mutex
+	free []*macState
+}
+
+// init sets the key of the pool and fills it with `n` states
+func (p *macPool) init(key []byte, n int) {
+	p.key = key
+	p.free = make([]*macState, n)
+	for i := range p.free {
+		p.free[i] = p.newState()
+	}
+}
+
+func (p *macPool) get() *macState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.free); n > 0 {
+		m := p.free[n-1]
+		p.free = p.free[:n-1]
+		return m
+	}
+	return p.newState()
+}
+
+// newState returns a MAC state that has been reset once, as the first Reset
+// of an HMAC allocates
+func (p *macPool) newState() *macState {
+	m := &macState{mac: hmac.New(sha256.New, p.key)}
+	m.mac.Reset()
+	return m
+}
+
+func (p *macPool) put(m *macState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.free = append(p.free, m)
+}
+
+// newV2Codec derives the stream key and nonce prefix for the stream with header `h`
+func newV2Codec(h *header, k *Key, o *options) (*v2Codec, error) {
+	fields, err := parseFields(h.ext, v2Fields...)
+	if err != nil {
+		return nil, err
+	}
+	salt := fields[fieldSalt]
+	if len(salt) != v2SaltSize {
+		return nil, fmt.Errorf("%w: invalid stream salt", ErrBadHeader)
+	}
+	id := fields[fieldStreamID]
+	if len(id) != v2StreamIDSize {
+		return nil, fmt.Errorf("%w: invalid stream ID", ErrBadHeader)
+	}
+	commit := fields[fieldCommit]
+	if len(commit) != v2CommitSize {
+		return nil, fmt.Errorf("%w: invalid key commitment", ErrBadHeader)
+	}
+	var flags byte
+	if f, ok := fields[fieldFlags]; ok {
+		if len(f) != 1 || f[0] == 0 || f[0]&^v2KnownFlags != 0 {
+			return nil, fmt.Errorf("%w: invalid mode flags %x", ErrBadHeader, f)
+		}
+		flags = f[0]
+	}
+	addressed := flags&flagAddressed != 0
+	if addressed && flags&(flagDeterministic|flagContentDefined) != flagDeterministic|flagContentDefined {
+		return nil, fmt.Errorf("%w: invalid mode flags %x", ErrBadHeader, flags)
+	}
+	if flags&flagDeterministic != 0 && o.checkpoint != nil {
+		return nil, errDeterministicCheckpoint
+	}
+	if raw := flags&flagRawKey != 0; raw != k.raw {
+		if raw {
+			return nil, fmt.Errorf("%w: the stream needs a raw key", ErrWrongKey)
+		}
+		return nil, fmt.Errorf("%w: the stream was not encrypted with a raw key", ErrWrongKey)
+	}
+	digest := sha256.Sum256(h.marshal())
+	adDigest := sha256.Sum256(o.ad)
+
+	master := k.master()
+	defer clear(master[:])
+	want, err := v2Commitment(master[:], salt)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(commit, want) {
+		return nil, ErrWrongKey
+	}
+	key, err := hkdf.Key(sha256.New, master[:], salt, "cryptod 2 stream key", 32)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := hkdf.Key(sha256.New, master[:], salt, "cryptod 2 nonce prefix", v2PrefixSize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	v := &v2Codec{h: h, gcm: gcm, prefix: prefix, flags: flags}
+	v.ad = append(append(append([]byte(nil), id...), digest[:]...), adDigest[:]...)
+	if flags&flagDeterministic != 0 {
+		if v.sivKey, err = hkdf.Key(sha256.New, master[:], salt, "cryptod 2 synthetic nonce", 32); err != nil {
+			return nil, err
+		}
+		if v.orderKey, err = hkdf.Key(sha256.New, master[:], salt, "cryptod 2 chunk order", 32); err != nil {
+			return nil, err
+		}
+		v.sivMACs.init(v.sivKey, o.concurrency)
+		v.orderMACs.init(v.orderKey, o.concurrency)
+	}
+	return v, nil
+}
+
+// v2Commitment returns the commitment to key `master` for a stream with salt `salt`
+func v2Commitment(master []byte, salt []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, master, salt, "cryptod 2 key commitment", v2CommitSize)
+}
+
+func (v *v2Codec) header() *header {
+	return v.h
+}
+
+func (v *v2Codec) nonceSize() int {
+	return v.gcm.NonceSize()
+}
+
+func (v *v2Codec) overhead() int {
+	return v.gcm.Overhead()
+}
+
+func (v *v2Codec) seal(dst []byte, nonce []byte, p []byte, ctr uint64) ([]byte, error) {
+	// the end of stream marker needs the next counter
+	if ctr == 0 || ctr >= math.MaxUint64 {
+		return nil, ErrCounterExhausted
+	}
+	aad := v.aad(ctr, false)
+	defer aadBufs.Put(aad)
+	v.nonce(nonce, *aad, p, ctr)
+	c := v.gcm.Seal(dst[:0], nonce, p, *aad)
+	v.bindOrder(ctr, nonce)
+	return c, nil
+}
+
+func (v *v2Codec) sealTomb(dst []byte, nonce []byte, ctr uint64) ([]byte, error) {
+	if ctr == 0 {
+		return nil, ErrCounterExhausted
+	}
+	aad := v.aad(ctr, true)
+	defer aadBufs.Put(aad)
+	v.nonce(nonce, *aad, nil, ctr)
+	return v.gcm.Seal(dst[:0], nonce, nil, *aad), nil
+}
+
+func (v *v2Codec) open(c []byte, nonce []byte, ctr uint64) ([]byte, error) {
+	if !v.checkNonce(nonce, ctr) {
+		return nil, ErrAuthentication
+	}
+	aad := v.aad(ctr, false)
+	defer aadBufs.Put(aad)
+	p, err := v.gcm.Open(c[:0], nonce, c, *aad)
+	if err != nil || !v.checkSynthetic(nonce, *aad, p) {
+		return nil, ErrAuthentication
+	}
+	v.bindOrder(ctr, nonce)
+	return p, nil
+}
+
+func (v *v2Codec) openTomb(c []byte, nonce []byte, ctr uint64) error {
+	if !v.checkNonce(nonce, ctr) {
+		return ErrAuthentication
+	}
+	aad := v.aad(ctr, true)
+	defer aadBufs.Put(aad)
+	if _, err := v.gcm.Open(nil, nonce, c, *aad); err != nil || !v.checkSynthetic(nonce, *aad, nil) {
+		return ErrAuthentication
+	}
+	return nil
+}
+
+func (v *v2Codec) counter(nonce []byte) (uint64, bool) {
+	// synthetic nonces don't record the counter
+	if v.sivKey != nil || len(nonce) != v.gcm.NonceSize() || !bytes.Equal(nonce[:v2PrefixSize], v.prefix) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(nonce[v2PrefixSize:]), true
+}
+
+func (v *v2Codec) variableChunks() bool {
+	return v.flags&flagContentDefined != 0
+}
+
+// nonce fills `nonce` with the nonce of chunk `ctr`, which has AAD `aad` and
+// plaintext `p`
+func (v *v2Codec) nonce(nonce []byte, aad []byte, p []byte, ctr uint64) {
+	if v.sivKey != nil {
+		m := v.sivMACs.get()
+		copy(nonce, v.synthetic(m, aad, p))
+		v.sivMACs.put(m)
+		return
+	}
+	copy(nonce, v.prefix)
+	binary.BigEndian.PutUint64(nonce[v2PrefixSize:], ctr)
+}
+
+// checkNonce reports whether `nonce` can be the nonce of chunk `ctr`
+func (v *v2Codec) checkNonce(nonce []byte, ctr uint64) bool {
+	if len(nonce) != v.gcm.NonceSize() {
+		return false
+	}
+	if v.sivKey != nil {
+		// checked against the plaintext once opened
+		return true
+	}
+	got, ok := v.counter(nonce)
+	return ok && got == ctr
+}
+
+// checkSynthetic reports whether `nonce` is the synthetic nonce of a chunk with
+// AAD `aad` and plaintext `p`, or true if the stream is not deterministic
+func (v *v2Codec) checkSynthetic(nonce []byte, aad []byte, p []byte) bool {
+	if v.sivKey == nil {
+		return true
+	}
+	m := v.sivMACs.get()
+	defer v.sivMACs.put(m)
+	return hmac.Equal(nonce, v.synthetic(m, aad, p))
+}
+
+// synthetic returns the synthetic nonce of a chunk with AAD `aad` and
+// plaintext `p`, computed with `m` from sivMACs and held in it until it is
+// put back
+func (v *v2Codec) synthetic(m *macState, aad []byte, p []byte) []byte {
+	m.mac.Reset()
+	m.mac.Write(aad)
+	m.mac.Write(p)
+	return m.mac.Sum(m.sum[:0])[:v.gcm.NonceSize()]
+}
+
+// bindOrder adds chunk `ctr`, sealed or opened with `nonce`, to the order
+// accumulator of a deterministic stream. Chunks may be added in any
+// order, but the end marker must come after all of them.
+func (v *v2Codec) bindOrder(ctr uint64, nonce []byte) {
+	if v.orderKey == nil {
+		return
+	}
+	m := v.orderMACs.get()
+	defer v.orderMACs.put(m)
+	m.mac.Reset()
+	binary.BigEndian.PutUint64(m.ctr[:], ctr)
+	m.mac.Write(m.ctr[:])
+	m.mac.Write(nonce)
+	sum := m.mac.Sum(m.sum[:0])
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for i := range v.order {
+		v.order[i] ^= sum[i]
+	}
+}
+
+// aad returns the AAD for chunk `ctr`, or for the end of stream marker
+// following chunk `ctr-1` if `final`, in a buffer from aadBufs. In a
+// deterministic stream the end marker's AAD has the order accumulator after
+// the counter, and in a content-addressed one chunk AADs have no counter.
+func (v *v2Codec) aad(ctr uint64, final bool) *[]byte {
+	aad := aadBufs.Get().(*[]byte)
+	b := append((*aad)[:0], v.ad...)
+	if final || v.flags&flagAddressed == 0 {
+		b = binary.BigEndian.AppendUint64(b, ctr)
+	}
+	if final && v.orderKey != nil {
+		v.mu.Lock()
+		b = append(b, v.order[:]...)
+		v.mu.Unlock()
+	}
+	if final {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	*aad = b
+	return aad
+}
@@ -0,0 +1,273 @@
+package cryptod
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+// encryptFrom encrypts `p` in format `f` with chunk counters starting after `start`
+func encryptFrom(t *testing.T, f Format, start uint64, p []byte, workers int) ([]byte, error) {
+	t.Helper()
+	o := newOptions([]Option{WithFormat(f), WithConcurrency(workers)})
+	enc, err := newStreamEncoder(nil, NewKey([]byte("secret key")), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	cw := &countingWriter{w: buf}
+	if err := enc.header().write(cw); err != nil {
+		t.Fatal(err)
+	}
+	tr := newTracker(o, nil, false, &cw.n)
+	tr.chunks = start
+	err = encryptChunks(context.Background(), fixedChunker{r: bytes.NewReader(p)}, cw, enc, o, tr, nil)
+	return buf.Bytes(), err
+}
+
+// decryptFrom decrypts `data` with chunk counters starting after `start`
+func decryptFrom(t *testing.T, start uint64, data []byte) ([]byte, error) {
+	t.Helper()
+	o := newOptions(nil)
+	cr := &countingReader{r: bytes.NewReader(data)}
+	h := &header{}
+	if err := h.read(cr); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := newStreamDecoder(h, NewKey([]byte("secret key")), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	tr := newTracker(o, nil, true, &cr.n)
+	tr.chunks = start
+	err = decryptChunks(context.Background(), cr, buf, dec, o, tr, nil)
+	return buf.Bytes(), err
+}
+
+func TestCounterExhaustion(t *testing.T) {
+	tests := []struct {
+		format Format
+		last   uint64 // last usable chunk counter
+	}{
+		{FormatV2, math.MaxUint64 - 1},
+		{FormatV1, math.MaxUint32},
+	}
+	plaintext := generatePlainText(chunkSize*3 + 10)
+
+	for _, tt := range tests {
+		for _, workers := range []int{1, 4} {
+			name := fmt.Sprintf("format %s, workers=%d", tt.format, workers)
+
+			// the last usable counters still work
+			data, err := encryptFrom(t, tt.format, tt.last-2, plaintext[:chunkSize*2], workers)
+			if err != nil {
+				t.Fatalf("%s: encrypt error: %v", name, err)
+			}
+			out, err := decryptFrom(t, tt.last-2, data)
+			if err != nil || !bytes.Equal(out, plaintext[:chunkSize*2]) {
+				t.Errorf("%s: decrypt error: %v", name, err)
+			}
+
+			// one more chunk fails rather than wrap
+			_, err = encryptFrom(t, tt.format, tt.last-2, plaintext, workers)
+			var se *StreamError
+			if !errors.Is(err, ErrCounterExhausted) || !errors.As(err, &se) || se.Chunk != tt.last+1 {
+				t.Errorf("%s: expected ErrCounterExhausted at chunk %d, got %v", name, tt.last+1, err)
+			}
+		}
+	}
+}
+
+func TestFormatV2Nonces(t *testing.T) {
+	plaintext := generatePlainText(chunkSize*3 + 10)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, "secret key"); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	chunks, header, tomb := parseEncryptedStream(t, data)
+
+	// nonces are a per-stream prefix followed by the 64-bit counter
+	var prefix []byte
+	for i, c := range append(chunks, tomb) {
+		nonce := extractNonceFromChunk(t, c)
+		if len(nonce) != 12 {
+			t.Fatalf("chunk %d: unexpected nonce size %d", i+1, len(nonce))
+		}
+		if prefix == nil {
+			prefix = nonce[:4]
+		}
+		want := append(append([]byte(nil), prefix...), 0, 0, 0, 0, 0, 0, 0, byte(i+1))
+		if !bytes.Equal(nonce, want) {
+			t.Errorf("chunk %d: expected nonce %x, got %x", i+1, want, nonce)
+		}
+	}
+
+	// streams get distinct salts, so distinct keys and prefixes
+	buf2 := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf2, "secret key"); err != nil {
+		t.Fatal(err)
+	}
+	_, header2, _ := parseEncryptedStream(t, buf2.Bytes())
+	if bytes.Equal(header, header2) {
+		t.Error("two streams have the same header")
+	}
+
+	// the end of stream marker is authenticated: an unsealed marker is rejected
+	forged := append([]byte(nil), data[:len(data)-len(tomb)]...)
+	fb := &bytes.Buffer{}
+	if err := writeChunkHeader(chunkHeader{nonce: extractNonceFromChunk(t, tomb), tomb: true}, fb); err != nil {
+		t.Fatal(err)
+	}
+	forged = append(forged, fb.Bytes()...)
+	if err := Decrypt(bytes.NewReader(forged), io.Discard, "secret key"); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("forged end marker: expected ErrAuthentication, got %v", err)
+	}
+
+	// so is cutting the stream at a chunk boundary and moving the marker up
+	cut := append(append([]byte(nil), data[:len(data)-len(tomb)-len(chunks[3])]...), tomb...)
+	if err := Decrypt(bytes.NewReader(cut), io.Discard, "secret key"); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("moved end marker: expected ErrAuthentication, got %v", err)
+	}
+}
+
+func TestFormatV2BadHeader(t *testing.T) {
+	salt := headerField{fieldSalt, make([]byte, v2SaltSize)}
+	id := headerField{fieldStreamID, make([]byte, v2StreamIDSize)}
+	commit := headerField{fieldCommit, make([]byte, v2CommitSize)}
+	for _, ext := range [][]byte{
+		marshalFields(headerField{fieldSalt, make([]byte, 8)}, id, commit),
+		marshalFields(salt, commit),
+		marshalFields(salt, headerField{fieldStreamID, make([]byte, 4)}, commit),
+		marshalFields(salt, id, headerField{fieldCommit, make([]byte, 16)}),
+		marshalFields(salt, id),
+		marshalFields(headerField{fieldFlags, []byte{flagDeterministic}}, salt, id),
+		nil,
+		marshalFields(salt, id, commit, headerField{'?', nil}),
+		marshalFields(salt, id, commit, salt),
+		marshalFields(headerField{fieldFlags, []byte{0}}, salt, id, commit),
+		marshalFields(headerField{fieldFlags, []byte{0x80}}, salt, id, commit),
+		marshalFields(headerField{fieldFlags, []byte{flagDeterministic, 0}}, salt, id, commit),
+		{fieldSalt, 40, 1, 2},
+	} {
+		h := &header{}
+		h.set(scheme, FormatV2, ext)
+		buf := &bytes.Buffer{}
+		if err := h.write(buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := Decrypt(buf, io.Discard, "key"); !errors.Is(err, ErrBadHeader) {
+			t.Errorf("ext %x: expected ErrBadHeader, got %v", ext, err)
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize*2 + 100)
+	encrypt := func(key string, opts ...Option) []byte {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		if err := Encrypt(bytes.NewReader(plaintext), buf, key, opts...); err != nil {
+			t.Fatalf("encrypt error: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	data := encrypt(key, WithDeterministic())
+	if !bytes.Equal(data, encrypt(key, WithDeterministic(), WithConcurrency(4))) {
+		t.Error("deterministic streams differ")
+	}
+	if bytes.Equal(data, encrypt(key)) {
+		t.Error("random stream equals deterministic stream")
+	}
+	if bytes.Equal(data, encrypt("other key", WithDeterministic())) {
+		t.Error("deterministic streams under different keys are equal")
+	}
+	tenant := WithAssociatedData([]byte("tenant"))
+	if bytes.Equal(data, encrypt(key, WithDeterministic(), tenant)) {
+		t.Error("deterministic streams with different associated data are equal")
+	}
+
+	// equal chunks at the same position are equal
+	chunks, _, _ := parseEncryptedStream(t, data)
+	changed := append([]byte(nil), plaintext...)
+	changed[chunkSize+10]++
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(changed), buf, key, WithDeterministic()); err != nil {
+		t.Fatal(err)
+	}
+	chunks2, _, _ := parseEncryptedStream(t, buf.Bytes())
+	if !bytes.Equal(chunks[0], chunks2[0]) || bytes.Equal(chunks[1], chunks2[1]) || !bytes.Equal(chunks[2], chunks2[2]) {
+		t.Error("expected only the changed chunk to differ")
+	}
+
+	// but a chunk spliced in from the other stream fails at the end marker
+	_, header, tomb := parseEncryptedStream(t, data)
+	spliced := bytes.Join([][]byte{header, chunks[0], chunks2[1], chunks[2], tomb}, nil)
+	for _, workers := range []int{1, 4} {
+		if err := Decrypt(bytes.NewReader(spliced), io.Discard, key, WithConcurrency(workers)); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("spliced, workers=%d: expected ErrAuthentication, got %v", workers, err)
+		}
+	}
+	cp := WithCheckpoint(func(*Checkpoint) error { return nil })
+	if err := Encrypt(bytes.NewReader(plaintext), io.Discard, key, WithDeterministic(), cp); !errors.Is(err, errDeterministicCheckpoint) {
+		t.Errorf("encrypt with checkpoints: expected errDeterministicCheckpoint, got %v", err)
+	}
+
+	info, err := Inspect(bytes.NewReader(data))
+	if err != nil || !info.Deterministic {
+		t.Errorf("expected the header to flag deterministic mode: %v, %+v", err, info)
+	}
+	if info, _ := Inspect(bytes.NewReader(encrypt(key))); info.Deterministic {
+		t.Error("random stream flagged deterministic")
+	}
+
+	for _, workers := range []int{1, 4} {
+		out := &bytes.Buffer{}
+		if err := Decrypt(bytes.NewReader(data), out, key, WithConcurrency(workers)); err != nil {
+			t.Fatalf("workers=%d: decrypt error: %v", workers, err)
+		}
+		if !bytes.Equal(out.Bytes(), plaintext) {
+			t.Errorf("workers=%d: plaintext mismatch", workers)
+		}
+	}
+
+	err = Encrypt(bytes.NewReader(plaintext), io.Discard, key, WithDeterministic(), WithFormat(FormatV1))
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("format 1.0: expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func TestDeterministicSyntheticNonce(t *testing.T) {
+	const key = "secret key"
+	o := newOptions([]Option{WithDeterministic()})
+	enc, err := newStreamEncoder(nil, NewKey([]byte(key)), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := enc.(*v2Codec)
+	p := []byte("chunk")
+
+	// a chunk sealed under the stream key but with a nonce that is not its
+	// synthetic nonce is rejected
+	nonce := make([]byte, v.nonceSize())
+	nonce[0] = 1
+	c := v.gcm.Seal(nil, nonce, p, *v.aad(1, false))
+	if _, err := v.open(c, nonce, 1); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("expected ErrAuthentication, got %v", err)
+	}
+
+	c, err = v.seal(nil, nonce, p, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := v.open(c, nonce, 1); err != nil || !bytes.Equal(got, p) {
+		t.Errorf("open error: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package cryptod
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// VerifyReport summarizes a stream checked by Verify.
+type VerifyReport struct {
+	Format          Format // format named by the stream header
+	Chunks          uint64 // number of data chunks authenticated
+	PlaintextBytes  int64  // total size of the authenticated plaintext
+	CiphertextBytes int64  // encrypted stream bytes read
+}
+
+// Verify authenticates every chunk of the encrypted stream `r` and its end of
+// stream marker without writing plaintext anywhere: each chunk is decrypted
+// into a scratch buffer that is overwritten by the next. A nil error means
+// Decrypt would succeed on the same input with the same options.
+//
+// If verification fails, the report covers the chunks authenticated before
+// the failure.
+func Verify(r io.Reader, skey string, opts ...Option) (*VerifyReport, error) {
+	return VerifyContext(context.Background(), r, skey, opts...)
+}
+
+// VerifyContext is like Verify but stops early when `ctx` is done.
+func VerifyContext(ctx context.Context, r io.Reader, skey string, opts ...Option) (*VerifyReport, error) {
+	key := passphraseKey(skey)
+	defer key.Destroy()
+	return VerifyWithKeyContext(ctx, r, key, opts...)
+}
+
+// VerifyWithKey is like Verify but takes the key as a Key.
+func VerifyWithKey(r io.Reader, key *Key, opts ...Option) (*VerifyReport, error) {
+	return VerifyWithKeyContext(context.Background(), r, key, opts...)
+}
+
+// VerifyWithKeyContext is like VerifyWithKey but stops early when `ctx` is done.
+func VerifyWithKeyContext(ctx context.Context, r io.Reader, key *Key, opts ...Option) (*VerifyReport, error) {
+	h, t, err := decryptStream(ctx, r, nil, key, newOptions(opts))
+	report := &VerifyReport{
+		Chunks:          t.chunks,
+		PlaintextBytes:  t.plain,
+		CiphertextBytes: *t.cipher,
+	}
+	if h != nil {
+		report.Format = h.format()
+	}
+	var se *StreamError
+	if errors.As(err, &se) {
+		se.Op = "verify"
+	}
+	return report, err
+}
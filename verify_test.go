@@ -0,0 +1,50 @@
+package cryptod
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	const key = "secret key"
+	plaintext := generatePlainText(chunkSize*2 + 100)
+	buf := &bytes.Buffer{}
+	if err := Encrypt(bytes.NewReader(plaintext), buf, key); err != nil {
+		t.Fatalf("encrypt error: %v", err)
+	}
+	data := buf.Bytes()
+
+	for _, workers := range []int{1, 4} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			report, err := Verify(bytes.NewReader(data), key, WithConcurrency(workers))
+			if err != nil {
+				t.Fatalf("verify error: %v", err)
+			}
+			want := VerifyReport{Format: FormatV2, Chunks: 3, PlaintextBytes: int64(len(plaintext)), CiphertextBytes: int64(len(data))}
+			if *report != want {
+				t.Errorf("expected report %+v, got %+v", want, *report)
+			}
+
+			tampered := append([]byte(nil), data...)
+			tampered[len(tampered)-100]++
+			report, err = Verify(bytes.NewReader(tampered), key, WithConcurrency(workers))
+			var se *StreamError
+			if !errors.Is(err, ErrAuthentication) || !errors.As(err, &se) || se.Op != "verify" || se.Chunk != 3 {
+				t.Errorf("expected verify failure at chunk 3, got %v", err)
+			}
+			// workers may stop before every earlier chunk is counted
+			if report.Chunks > 2 || (workers == 1 && report.Chunks != 2) {
+				t.Errorf("expected 2 chunks verified before the failure, got %d", report.Chunks)
+			}
+
+			if _, err := Verify(bytes.NewReader(data), "wrong key", WithConcurrency(workers)); !errors.Is(err, ErrAuthentication) {
+				t.Errorf("wrong key: expected ErrAuthentication, got %v", err)
+			}
+			if _, err := Verify(bytes.NewReader(data[:len(data)-1]), key, WithConcurrency(workers)); !errors.Is(err, ErrTruncated) {
+				t.Errorf("truncated: expected ErrTruncated, got %v", err)
+			}
+		})
+	}
+}